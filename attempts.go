@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sort"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Outcome of a single upstream call
+const (
+	OutcomeSuccess       = "success"
+	OutcomeFailure       = "failure"
+	OutcomeCancelled     = "cancelled"
+	OutcomeInvalidOutput = "invalid_output"
+)
+
+// attemptRetention is how long individual upstream calls are kept
+const attemptRetention = 7 * 24 * time.Hour
+
+// Attempt is one upstream call, recorded for model health statistics
+type Attempt struct {
+	Model            string
+	Outcome          string
+	ErrorClass       ErrorClass
+	Latency          time.Duration
+	TTFT             time.Duration // time to first token; equals Latency for non-streamed calls
+	PromptTokens     int
+	CompletionTokens int
+	At               time.Time
+}
+
+// ModelStats summarizes a model's recent attempts
+type ModelStats struct {
+	Model        string  `json:"model"`
+	Attempts     int     `json:"attempts"`
+	Successes    int     `json:"successes"`
+	SuccessRate  float64 `json:"success_rate"`
+	LatencyP50Ms int64   `json:"latency_p50_ms"`
+	LatencyP95Ms int64   `json:"latency_p95_ms"`
+	TTFTP50Ms    int64   `json:"ttft_p50_ms"`
+	TokensPerSec float64 `json:"tokens_per_sec"` // from streamed calls only; 0 without any
+}
+
+func createAttempts(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		model TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		error_class TEXT NOT NULL DEFAULT '',
+		latency_ms INTEGER NOT NULL,
+		ttft_ms INTEGER NOT NULL,
+		prompt_tokens INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS attempts_at ON attempts(at);
+	CREATE INDEX IF NOT EXISTS attempts_model_at ON attempts(model, at)`)
+	return err
+}
+
+func (s *FailureStore) RecordAttempt(a Attempt) error {
+	if a.At.IsZero() {
+		a.At = time.Now()
+	}
+	_, err := s.db.Exec(`INSERT INTO attempts(model, outcome, error_class, latency_ms, ttft_ms, prompt_tokens, completion_tokens, at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.Model, a.Outcome, string(a.ErrorClass), a.Latency.Milliseconds(), a.TTFT.Milliseconds(), a.PromptTokens, a.CompletionTokens, a.At.Unix())
+	return err
+}
+
+// ModelStats rolls up the attempts of the last window per model. Cancelled
+// calls say nothing about the model and are left out.
+func (s *FailureStore) ModelStats(window time.Duration) (map[string]ModelStats, error) {
+	rows, err := s.db.Query(`SELECT model, outcome, latency_ms, ttft_ms, completion_tokens FROM attempts WHERE at >= ? AND outcome != ?`,
+		time.Now().Add(-window).Unix(), OutcomeCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type samples struct {
+		stats            ModelStats
+		latencies, ttfts []int64
+		tokens           int64
+		generationMs     int64
+	}
+	byModel := make(map[string]*samples)
+	for rows.Next() {
+		var model, outcome string
+		var latency, ttft, completion int64
+		if err := rows.Scan(&model, &outcome, &latency, &ttft, &completion); err != nil {
+			return nil, err
+		}
+		m, ok := byModel[model]
+		if !ok {
+			m = &samples{stats: ModelStats{Model: model}}
+			byModel[model] = m
+		}
+		m.stats.Attempts++
+		if outcome != OutcomeSuccess {
+			continue
+		}
+		m.stats.Successes++
+		m.latencies = append(m.latencies, latency)
+		m.ttfts = append(m.ttfts, ttft)
+		// Throughput needs the generation time after the first token, which
+		// only streamed calls measure; non-streamed ones record TTFT = latency
+		if completion > 0 && ttft < latency {
+			m.tokens += completion
+			m.generationMs += latency - ttft
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]ModelStats, len(byModel))
+	for model, m := range byModel {
+		m.stats.SuccessRate = float64(m.stats.Successes) / float64(m.stats.Attempts)
+		m.stats.LatencyP50Ms = percentile(m.latencies, 50)
+		m.stats.LatencyP95Ms = percentile(m.latencies, 95)
+		m.stats.TTFTP50Ms = percentile(m.ttfts, 50)
+		if m.generationMs > 0 {
+			m.stats.TokensPerSec = float64(m.tokens) / (float64(m.generationMs) / 1000)
+		}
+		result[model] = m.stats
+	}
+	return result, nil
+}
+
+// percentile returns the nearest-rank percentile of values
+func percentile(values []int64, p int) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank-1, 0)]
+}
+
+// Compact deletes attempts older than the retention period and reclaims the
+// space they used
+func (s *FailureStore) Compact() error {
+	res, err := s.db.Exec(`DELETE FROM attempts WHERE at < ?`, time.Now().Add(-attemptRetention).Unix())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("compacted attempt history", "deleted", n)
+		_, err = s.db.Exec(`VACUUM`)
+	}
+	return err
+}
+
+// recordAttempt stores an attempt when the health store is enabled, logging
+// rather than failing the request on database errors
+func (s *server) recordAttempt(a Attempt) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.RecordAttempt(a); err != nil {
+		slog.Error("failed to record attempt", "model", a.Model, "error", err)
+	}
+	s.recordSpend(a)
+}
+
+// attemptFromResult builds the Attempt for a finished non-streamed call
+func attemptFromResult(model string, start time.Time, promptTokens, completionTokens int, err error) Attempt {
+	latency := time.Since(start)
+	a := Attempt{
+		Model:            model,
+		Outcome:          OutcomeSuccess,
+		Latency:          latency,
+		TTFT:             latency,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		At:               start,
+	}
+	if err != nil {
+		a.Outcome = OutcomeFailure
+		a.ErrorClass = classifyError(err).Class
+	}
+	return a
+}
+
+// outputError reports a response that arrived but does not satisfy the
+// requested response_format
+type outputError struct{ err error }
+
+func (e *outputError) Error() string { return e.err.Error() }
+func (e *outputError) Unwrap() error { return e.err }
+
+// recordedChat runs a non-streamed chat completion on model, validates any
+// structured output and records the attempt. Non-conforming output is
+// returned as an *outputError.
+func (s *server) recordedChat(ctx context.Context, req ChatRequest, model string) (openai.ChatCompletionResponse, error) {
+	start := time.Now()
+	provider, upstreamModel := s.providers.Route(model)
+	resp, err := provider.Chat(ctx, req, upstreamModel)
+	a := attemptFromResult(model, start, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, err)
+	switch {
+	case isCancelled(ctx, err):
+		a.Outcome, a.ErrorClass = OutcomeCancelled, ""
+	case err == nil:
+		if checkErr := checkStructuredOutput(req, &resp); checkErr != nil {
+			a.Outcome = OutcomeInvalidOutput
+			err = &outputError{err: checkErr}
+		}
+	}
+	s.recordAttempt(a)
+	return resp, err
+}
+
+// openStream opens a chat completion stream on model. Only failures to open
+// are recorded here; streams that open are recorded by failoverStream once
+// they finish.
+func (s *server) openStream(ctx context.Context, req ChatRequest, model string) (chatStream, error) {
+	start := time.Now()
+	provider, upstreamModel := s.providers.Route(model)
+	stream, err := provider.ChatStream(ctx, req, upstreamModel)
+	if err != nil {
+		a := attemptFromResult(model, start, 0, 0, err)
+		if isCancelled(ctx, err) {
+			a.Outcome, a.ErrorClass = OutcomeCancelled, ""
+		}
+		s.recordAttempt(a)
+	}
+	return stream, err
+}
+
+// compactAttempts applies the retention policy at startup and then hourly
+func compactAttempts(store *FailureStore) {
+	for {
+		if err := store.Compact(); err != nil {
+			slog.Error("failed to compact attempt history", "error", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// catalogService owns the models clients see and can route to: discovery (the
+// cached OpenRouter catalog and the free models derived from it), the
+// models-filter, hiding benched models and resolving client model names. Every
+// handler goes through it, so all endpoints agree in every mode.
+type catalogService struct {
+	current atomic.Pointer[catalogSnapshot]
+	filter  atomic.Pointer[modelFilter]
+
+	store    *FailureStore // hides benched models from listings when set
+	freeMode bool
+}
+
+// catalogSnapshot pairs a catalog with the free model set derived from it, so
+// readers never see one without the other
+type catalogSnapshot struct {
+	catalog *modelCatalog
+	free    *freeModelSet
+}
+
+func newCatalogService(store *FailureStore, freeMode bool) *catalogService {
+	return &catalogService{store: store, freeMode: freeMode}
+}
+
+// listedModel is a model as offered to clients
+type listedModel struct {
+	ID   string // full OpenRouter ID
+	Name string // name shown to and sent by clients
+	Info catalogModel
+}
+
+// displayName is the name clients see for a full model ID
+func displayName(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// snapshot returns the current catalog and free model set; callers that need
+// both take them from one snapshot
+func (s *catalogService) snapshot() *catalogSnapshot {
+	if snap := s.current.Load(); snap != nil {
+		return snap
+	}
+	return &catalogSnapshot{catalog: newModelCatalog(nil, time.Time{}), free: &freeModelSet{}}
+}
+
+// Catalog returns the current catalog, which callers must not modify
+func (s *catalogService) Catalog() *modelCatalog {
+	return s.snapshot().catalog
+}
+
+// FreeModels returns the current free model set, which callers must not modify
+func (s *catalogService) FreeModels() *freeModelSet {
+	return s.snapshot().free
+}
+
+// Update swaps in a new catalog and the free model set derived from it,
+// returning the previous ones, which are nil before the first update
+func (s *catalogService) Update(c *modelCatalog) (*modelCatalog, *freeModelSet) {
+	prev := s.current.Swap(&catalogSnapshot{catalog: c, free: indexFreeModels(freeModelsFromCatalog(c))})
+	if prev == nil {
+		return nil, nil
+	}
+	return prev.catalog, prev.free
+}
+
+// SetFilter replaces the models-filter; a nil filter allows every model
+func (s *catalogService) SetFilter(filter *modelFilter) {
+	s.filter.Store(filter)
+}
+
+// Allowed reports whether the models-filter admits a full model ID
+func (s *catalogService) Allowed(id string) bool {
+	return s.filter.Load().Allows(id)
+}
+
+// Offered returns the IDs clients may pick before filtering: the free models
+// and those of the other registered providers in free mode, otherwise every
+// catalog model, tool-capable ones only when TOOL_USE_ONLY is set
+func (s *catalogService) Offered() []string {
+	snap := s.snapshot()
+	catalog := snap.catalog
+	if s.freeMode {
+		ids := append([]string(nil), snap.free.IDs...)
+		for _, m := range catalog.Models {
+			if m.Provider != "" {
+				ids = append(ids, m.ID)
+			}
+		}
+		return ids
+	}
+	toolUseOnly := strings.ToLower(os.Getenv("TOOL_USE_ONLY")) == "true"
+	ids := make([]string, 0, len(catalog.Models))
+	for _, m := range catalog.Models {
+		if toolUseOnly && !supportsToolUse(m.SupportedParameters) {
+			continue
+		}
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// Routable reports whether id is offered and admitted by the filter
+func (s *catalogService) Routable(id string) bool {
+	return s.Allowed(id) && contains(s.Offered(), id)
+}
+
+// List returns the models to show clients: in free mode the virtual models
+// first, then those offered, admitted by the filter and not currently benched
+// after failures
+func (s *catalogService) List() []listedModel {
+	catalog := s.Catalog()
+	var models []listedModel
+	if s.freeMode {
+		models = s.listVirtual()
+	}
+	for _, id := range s.Offered() {
+		if !s.Allowed(id) {
+			continue
+		}
+		if s.store != nil {
+			skip, err := s.store.ShouldSkip(id)
+			if err != nil {
+				slog.Error("db error checking model", "model", id, "error", err)
+				continue
+			}
+			if skip {
+				continue // Hide recently failed models
+			}
+		}
+		models = append(models, listedModel{ID: id, Name: displayName(id), Info: catalog.Model(id)})
+	}
+	return models
+}
+
+// Resolve maps a client model name to a full model ID: an exact ID, then a
+// display name, then an ID ending in name, among the routable models. Unknown
+// names are returned unchanged so models missing from the catalog can still
+// be requested directly.
+func (s *catalogService) Resolve(name string) string {
+	offered := s.Offered()
+	if contains(offered, name) {
+		return name
+	}
+	for _, id := range offered {
+		if displayName(id) == name && s.Allowed(id) {
+			return id
+		}
+	}
+	for _, id := range offered {
+		if strings.HasSuffix(id, name) && s.Allowed(id) {
+			return id
+		}
+	}
+	return name
+}
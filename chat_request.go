@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ChatRequest is an inbound chat request forwarded upstream. Extra carries body
+// fields that openai.ChatCompletionRequest drops or cannot express, such as an
+// explicit temperature of 0 (lost to omitempty) or OpenRouter's top_k.
+type ChatRequest struct {
+	openai.ChatCompletionRequest
+	Extra map[string]any
+}
+
+// zeroableFields are sampling parameters where 0 is meaningful but go-openai
+// omits the field when it is zero
+var zeroableFields = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty"}
+
+// passthroughFields are OpenRouter parameters without a go-openai equivalent
+var passthroughFields = []string{"top_k", "min_p", "top_a", "repetition_penalty", "provider", "transforms", "reasoning", "include_reasoning", "models", "route"}
+
+// parseChatRequest decodes an OpenAI chat completion body, keeping explicit
+// zero sampling values and OpenRouter-only parameters in Extra
+func parseChatRequest(body []byte) (ChatRequest, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return ChatRequest{}, err
+	}
+
+	// OpenAI accepts "stop" as a single string as well as an array
+	if stop, ok := raw["stop"]; ok && len(stop) > 0 && stop[0] == '"' {
+		var s string
+		if err := json.Unmarshal(stop, &s); err != nil {
+			return ChatRequest{}, err
+		}
+		raw["stop"], _ = json.Marshal([]string{s})
+		body, _ = json.Marshal(raw)
+	}
+
+	// go-openai cannot decode a JSON schema response_format, so it is parsed separately
+	responseFormat, hasResponseFormat := raw["response_format"]
+	if hasResponseFormat {
+		delete(raw, "response_format")
+		body, _ = json.Marshal(raw)
+	}
+
+	var req ChatRequest
+	if err := json.Unmarshal(body, &req.ChatCompletionRequest); err != nil {
+		return ChatRequest{}, err
+	}
+	if hasResponseFormat && string(responseFormat) != "null" {
+		format, err := parseResponseFormat(responseFormat)
+		if err != nil {
+			return ChatRequest{}, err
+		}
+		req.ResponseFormat = format
+	}
+
+	for _, field := range zeroableFields {
+		var v float64
+		if value, ok := raw[field]; ok && json.Unmarshal(value, &v) == nil && v == 0 {
+			req.setExtra(field, 0)
+		}
+	}
+	for _, field := range passthroughFields {
+		if value, ok := raw[field]; ok {
+			req.setExtra(field, value)
+		}
+	}
+
+	// OpenRouter's fallback routing: a models array, with route "fallback" or none
+	if models, ok := raw["models"]; ok {
+		var ids []string
+		if err := json.Unmarshal(models, &ids); err != nil {
+			return ChatRequest{}, fmt.Errorf("models: %w", err)
+		}
+	}
+	if route, ok := raw["route"]; ok && string(route) != "null" {
+		var r string
+		if err := json.Unmarshal(route, &r); err != nil || r != "fallback" {
+			return ChatRequest{}, fmt.Errorf("unsupported route %s", route)
+		}
+	}
+	return req, nil
+}
+
+func (r *ChatRequest) setExtra(key string, value any) {
+	if r.Extra == nil {
+		r.Extra = make(map[string]any)
+	}
+	r.Extra[key] = value
+}
+
+// extraFieldsKey is the context key used to hand ChatRequest.Extra to extraFieldsTransport
+type extraFieldsKey struct{}
+
+func withExtraFields(ctx context.Context, extra map[string]any) context.Context {
+	if len(extra) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, extraFieldsKey{}, extra)
+}
+
+// extraFieldsTransport merges extra fields from the request context into the
+// JSON body built by go-openai before it is sent upstream
+type extraFieldsTransport struct {
+	base http.RoundTripper
+}
+
+func (t extraFieldsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	extra, ok := req.Context().Value(extraFieldsKey{}).(map[string]any)
+	if !ok || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if fields[k], err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	if body, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	return t.base.RoundTrip(req)
+}
+
+// requestHasImages reports whether any message carries an image part
+func requestHasImages(req ChatRequest) bool {
+	for _, m := range req.Messages {
+		for _, part := range m.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// responseHeaderKey is the context key for the holder that
+// responseHeaderTransport fills with upstream response headers
+type responseHeaderKey struct{}
+
+func withResponseHeader(ctx context.Context) (context.Context, *http.Header) {
+	header := new(http.Header)
+	return context.WithValue(ctx, responseHeaderKey{}, header), header
+}
+
+// responseHeaderTransport records upstream response headers, such as
+// Retry-After, that go-openai does not expose on errors
+type responseHeaderTransport struct {
+	base http.RoundTripper
+}
+
+func (t responseHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if header, ok := req.Context().Value(responseHeaderKey{}).(*http.Header); ok && resp != nil {
+		*header = resp.Header
+	}
+	return resp, err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// failoverStream wraps an upstream chat completion stream. In free mode, when
+// the current model dies mid-response or ends without producing anything, it
+// marks the model failed and continues on the next eligible free model, handing
+// it the partial assistant output as a prefill so the client sees one response.
+type failoverStream struct {
+	ctx       context.Context
+	srv       *server
+	req       ChatRequest
+	stream    chatStream
+	model     string
+	requested string // as sent by the client; failover stays within its virtual model or chain
+	tried     map[string]bool
+	partial   strings.Builder
+	output    int  // characters the current model has streamed
+	produced  bool // whether the current model has sent any output
+	toolCall  bool // tool call deltas cannot be resumed on another model
+
+	// Attempt bookkeeping for the current model
+	start      time.Time
+	firstToken time.Time
+	usage      *openai.Usage
+	recorded   bool
+}
+
+func newFailoverStream(ctx context.Context, srv *server, req ChatRequest, stream chatStream, model, requested string) *failoverStream {
+	return &failoverStream{
+		ctx:       ctx,
+		srv:       srv,
+		req:       req,
+		stream:    stream,
+		model:     model,
+		requested: requested,
+		tried:     map[string]bool{model: true},
+		start:     time.Now(),
+	}
+}
+
+// Model returns the model currently serving the stream
+func (s *failoverStream) Model() string { return s.model }
+
+// Close closes the upstream stream. A stream closed before it finished was
+// abandoned by the client.
+func (s *failoverStream) Close() error {
+	s.record(OutcomeCancelled, nil)
+	return s.stream.Close()
+}
+
+// Recv returns the next chunk both decoded and as the raw upstream JSON
+func (s *failoverStream) Recv() (openai.ChatCompletionStreamResponse, []byte, error) {
+	for {
+		raw, err := s.stream.RecvRaw()
+		if err == nil {
+			var response openai.ChatCompletionStreamResponse
+			if err = json.Unmarshal(raw, &response); err != nil {
+				return response, nil, err
+			}
+			// OpenRouter reports provider failures mid-stream as finish_reason "error"
+			if len(response.Choices) == 0 || response.Choices[0].FinishReason != "error" {
+				s.observe(response)
+				return response, raw, nil
+			}
+			err = errors.New("upstream reported an error mid-stream")
+		}
+
+		if isCancelled(s.ctx, err) {
+			s.record(OutcomeCancelled, nil)
+			return openai.ChatCompletionStreamResponse{}, nil, err
+		}
+		if errors.Is(err, io.EOF) && s.produced {
+			s.record(OutcomeSuccess, nil)
+			return openai.ChatCompletionStreamResponse{}, nil, err
+		}
+		if errors.Is(err, io.EOF) {
+			err = errors.New("stream ended without output")
+		}
+		s.record(OutcomeFailure, err)
+		if !s.failover(err) {
+			return openai.ChatCompletionStreamResponse{}, nil, err
+		}
+	}
+}
+
+func (s *failoverStream) observe(response openai.ChatCompletionStreamResponse) {
+	if response.Usage != nil {
+		s.usage = response.Usage
+	}
+	for _, choice := range response.Choices {
+		if s.firstToken.IsZero() && (choice.Delta.Content != "" || len(choice.Delta.ToolCalls) > 0) {
+			s.firstToken = time.Now()
+		}
+		s.partial.WriteString(choice.Delta.Content)
+		s.output += len(choice.Delta.Content)
+		for _, call := range choice.Delta.ToolCalls {
+			s.output += len(call.Function.Name) + len(call.Function.Arguments)
+		}
+		if choice.Delta.Content != "" || choice.FinishReason != "" {
+			s.produced = true
+		}
+		if len(choice.Delta.ToolCalls) > 0 {
+			s.produced = true
+			s.toolCall = true
+		}
+	}
+}
+
+// failover switches to the next free model after cause, reporting whether the
+// stream can continue
+func (s *failoverStream) failover(cause error) bool {
+	if !s.srv.freeMode || s.toolCall {
+		return false
+	}
+	slog.Warn("model failed mid-stream, failing over", "model", s.model, "error", cause)
+	_ = s.srv.store.MarkFailure(s.model, cause)
+	s.stream.Close()
+
+	req := s.req
+	if partial := s.partial.String(); partial != "" {
+		req.Messages = append(append([]openai.ChatCompletionMessage{}, s.req.Messages...), openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleAssistant,
+			Content: partial,
+		})
+	}
+	stream, model, err := s.srv.resumeStream(s.ctx, req, s.requested, s.tried)
+	if err != nil {
+		slog.Error("mid-stream failover found no replacement", "error", fmt.Errorf("%w after %v", err, cause))
+		return false
+	}
+	slog.Info("resumed stream on another model", "from", s.model, "to", model, "partialChars", s.partial.Len())
+	s.stream, s.model, s.produced, s.output = stream, model, false, 0
+	s.start, s.firstToken, s.usage, s.recorded = time.Now(), time.Time{}, nil, false
+	s.tried[model] = true
+	return true
+}
+
+// record stores the attempt of the current model once
+func (s *failoverStream) record(outcome string, err error) {
+	if s.recorded {
+		return
+	}
+	s.recorded = true
+	a := Attempt{Model: s.model, Outcome: outcome, Latency: time.Since(s.start), At: s.start}
+	a.TTFT = a.Latency
+	if !s.firstToken.IsZero() {
+		a.TTFT = s.firstToken.Sub(s.start)
+	}
+	if s.usage != nil {
+		a.PromptTokens, a.CompletionTokens = s.usage.PromptTokens, s.usage.CompletionTokens
+	} else if s.srv.paid.IsPaid(s.model) {
+		// A cancelled or broken stream reports no usage but is still billed
+		a.PromptTokens, a.CompletionTokens = estimatePromptTokens(s.req), estimateTokens(s.output)
+	}
+	if err != nil {
+		a.ErrorClass = classifyError(err).Class
+	}
+	s.srv.recordAttempt(a)
+}
@@ -1,11 +1,162 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ErrorClass categorizes upstream failures so each can get its own cooldown
+type ErrorClass string
+
+const (
+	ErrorRateLimit      ErrorClass = "rate_limit"
+	ErrorQuotaExhausted ErrorClass = "quota_exhausted"
+	ErrorContextLength  ErrorClass = "context_length"
+	ErrorInvalidRequest ErrorClass = "invalid_request"
+	ErrorAuth           ErrorClass = "auth"
+	ErrorServer         ErrorClass = "server"
+	ErrorTimeout        ErrorClass = "timeout"
+	ErrorUnknown        ErrorClass = "unknown"
+)
+
+const (
+	defaultCooldown   = 5 * time.Minute
+	rateLimitCooldown = time.Minute
+	backoffBase       = time.Minute
+	backoffMax        = 30 * time.Minute
 )
 
+// upstreamError carries the response headers of a failed upstream call, which
+// go-openai's own error types drop
+type upstreamError struct {
+	err    error
+	header http.Header
+}
+
+func (e *upstreamError) Error() string { return e.err.Error() }
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// Failure is a classified upstream error
+type Failure struct {
+	Class   ErrorClass
+	Status  int
+	Message string
+	// RetryAt is when the upstream said it will accept requests again, if it did
+	RetryAt time.Time
+}
+
+// classifyError derives the failure class, HTTP status and retry hint from an
+// upstream error
+func classifyError(err error) Failure {
+	f := Failure{Class: ErrorUnknown, Message: err.Error()}
+
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		f.Status = apiErr.HTTPStatusCode
+		f.Message = apiErr.Message
+	case errors.As(err, &reqErr):
+		f.Status = reqErr.HTTPStatusCode
+	}
+	var upErr *upstreamError
+	if errors.As(err, &upErr) && upErr.header != nil {
+		f.RetryAt = retryAtFromHeader(upErr.header, time.Now())
+	}
+
+	message := strings.ToLower(f.Message)
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) ||
+		f.Status == http.StatusRequestTimeout || f.Status == http.StatusGatewayTimeout:
+		f.Class = ErrorTimeout
+	case f.Status == http.StatusPaymentRequired ||
+		(f.Status == http.StatusTooManyRequests && (strings.Contains(message, "per-day") || strings.Contains(message, "per day") || strings.Contains(message, "quota") || strings.Contains(message, "credits"))):
+		f.Class = ErrorQuotaExhausted
+	case f.Status == http.StatusTooManyRequests:
+		f.Class = ErrorRateLimit
+	case f.Status == http.StatusUnauthorized || f.Status == http.StatusForbidden:
+		f.Class = ErrorAuth
+	case f.Status >= 400 && f.Status < 500 &&
+		(strings.Contains(message, "context length") || strings.Contains(message, "context window") || strings.Contains(message, "maximum context") || strings.Contains(message, "too many tokens")):
+		f.Class = ErrorContextLength
+	case f.Status >= 400 && f.Status < 500:
+		f.Class = ErrorInvalidRequest
+	case f.Status >= 500:
+		f.Class = ErrorServer
+	}
+	return f
+}
+
+// retryAtFromHeader reads Retry-After (seconds or HTTP date) or OpenRouter's
+// X-RateLimit-Reset (epoch milliseconds)
+func retryAtFromHeader(header http.Header, now time.Time) time.Time {
+	if v := header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return now.Add(time.Duration(seconds) * time.Second)
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return t
+		}
+	}
+	if v := header.Get("X-RateLimit-Reset"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			switch {
+			case n > 1e12:
+				return time.UnixMilli(n)
+			case n > 1e9:
+				return time.Unix(n, 0)
+			default:
+				return now.Add(time.Duration(n) * time.Second)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// isAuthError reports whether err is the upstream rejecting our key, which
+// fails the same way on every model
+func isAuthError(err error) bool {
+	return classifyError(err).Class == ErrorAuth
+}
+
+// benchUntil applies the per-class policy, returning when the model may be
+// used again; a zero time means the failure does not bench the model.
+// consecutive counts failures of the same class in a row, this one included.
+func (f Failure) benchUntil(now time.Time, consecutive int) time.Time {
+	switch f.Class {
+	case ErrorInvalidRequest, ErrorContextLength, ErrorAuth:
+		// Caused by the request or our key, not by the model
+		return time.Time{}
+	case ErrorRateLimit:
+		if !f.RetryAt.IsZero() {
+			return f.RetryAt
+		}
+		return now.Add(rateLimitCooldown)
+	case ErrorQuotaExhausted:
+		if !f.RetryAt.IsZero() {
+			return f.RetryAt
+		}
+		// OpenRouter's daily free-model quotas reset at midnight UTC
+		return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	case ErrorServer, ErrorTimeout:
+		backoff := backoffBase << min(consecutive-1, 5)
+		return now.Add(min(backoff, backoffMax))
+	}
+	return now.Add(defaultCooldown)
+}
+
 type FailureStore struct {
 	db *sql.DB
 }
@@ -19,27 +170,123 @@ func NewFailureStore(path string) (*FailureStore, error) {
 		db.Close()
 		return nil, err
 	}
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return &FailureStore{db: db}, nil
 }
 
+// migrations upgrade the schema in order; PRAGMA user_version records how many
+// have been applied. Each must also be safe on databases that predate
+// versioning, which may already contain some of its changes.
+var migrations = []func(*sql.DB) error{
+	migrateFailures,
+	createAttempts,
+	createSpend,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := migrations[i](db); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFailures adds the classification columns to failures tables created
+// before errors were classified
+func migrateFailures(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(failures)`)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+
+	columns := []struct{ name, def string }{
+		{"error_class", "TEXT NOT NULL DEFAULT 'unknown'"},
+		{"status", "INTEGER NOT NULL DEFAULT 0"},
+		{"message", "TEXT NOT NULL DEFAULT ''"},
+		{"retry_at", "INTEGER"},
+		{"consecutive", "INTEGER NOT NULL DEFAULT 1"},
+	}
+	for _, col := range columns {
+		if existing[col.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE failures ADD COLUMN %s %s`, col.name, col.def)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *FailureStore) Close() error { return s.db.Close() }
 
-func (s *FailureStore) MarkFailure(model string) error {
-	_, err := s.db.Exec(`INSERT INTO failures(model, failed_at) VALUES(?, ?) ON CONFLICT(model) DO UPDATE SET failed_at=excluded.failed_at`, model, time.Now().Unix())
-	return err
+// MarkFailure classifies err and benches the model according to its class.
+// Client-side errors are recorded but never bench the model.
+func (s *FailureStore) MarkFailure(model string, err error) error {
+	f := classifyError(err)
+	now := time.Now()
+
+	consecutive := 1
+	var lastClass string
+	var lastCount int
+	row := s.db.QueryRow(`SELECT error_class, consecutive FROM failures WHERE model=?`, model)
+	if scanErr := row.Scan(&lastClass, &lastCount); scanErr == nil && ErrorClass(lastClass) == f.Class {
+		consecutive = lastCount + 1
+	}
+
+	until := f.benchUntil(now, consecutive)
+	if until.IsZero() {
+		// Keep the record, but let the model be used again right away
+		slog.Info("not benching model for request-side error", "model", model, "class", f.Class, "status", f.Status)
+		until = now
+	} else {
+		slog.Info("benching model", "model", model, "class", f.Class, "status", f.Status, "until", until.Format(time.RFC3339))
+	}
+
+	_, execErr := s.db.Exec(`INSERT INTO failures(model, failed_at, error_class, status, message, retry_at, consecutive) VALUES(?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(model) DO UPDATE SET failed_at=excluded.failed_at, error_class=excluded.error_class, status=excluded.status,
+		message=excluded.message, retry_at=excluded.retry_at, consecutive=excluded.consecutive`,
+		model, now.Unix(), string(f.Class), f.Status, f.Message, until.Unix(), consecutive)
+	return execErr
 }
 
 func (s *FailureStore) ShouldSkip(model string) (bool, error) {
 	var ts int64
-	err := s.db.QueryRow(`SELECT failed_at FROM failures WHERE model=?`, model).Scan(&ts)
+	var retryAt sql.NullInt64
+	err := s.db.QueryRow(`SELECT failed_at, retry_at FROM failures WHERE model=?`, model).Scan(&ts, &retryAt)
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
 	if err != nil {
 		return false, err
 	}
-	// Reduced cooldown from 15 minutes to 5 minutes for faster recovery
-	if time.Since(time.Unix(ts, 0)) < 5*time.Minute {
+	if retryAt.Valid {
+		return time.Now().Before(time.Unix(retryAt.Int64, 0)), nil
+	}
+	// Rows recorded before classification keep the flat cooldown
+	if time.Since(time.Unix(ts, 0)) < defaultCooldown {
 		return true, nil
 	}
 	return false, nil
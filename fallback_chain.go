@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// fallbackChain returns the models a client asked to be tried in order, or
+// nil for a plain model name. A chain is written as "a|b|c" in the model
+// name or sent as OpenRouter's models array, which follows the model field.
+// Names are resolved like single model names.
+func (s *server) fallbackChain(req ChatRequest, requestedModel string) []string {
+	var names []string
+	if strings.Contains(requestedModel, "|") {
+		names = strings.Split(requestedModel, "|")
+	} else if requestedModel != "" {
+		names = []string{requestedModel}
+	}
+	models, hasModels := req.Extra["models"].(json.RawMessage)
+	if hasModels {
+		var extra []string
+		_ = json.Unmarshal(models, &extra) // validated by parseChatRequest
+		names = append(names, extra...)
+	}
+	if !hasModels && len(names) < 2 {
+		return nil
+	}
+
+	var chain []string
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if id := s.models.Resolve(name); !contains(chain, id) {
+			chain = append(chain, id)
+		}
+	}
+	return chain
+}
+
+// withoutChainFields drops the fallback routing fields, which the proxy
+// applies itself rather than forwarding upstream
+func withoutChainFields(req ChatRequest) ChatRequest {
+	extra := make(map[string]any, len(req.Extra))
+	for k, v := range req.Extra {
+		if k != "models" && k != "route" {
+			extra[k] = v
+		}
+	}
+	req.Extra = extra
+	return req
+}
+
+// chainCandidate reports why model cannot be tried for req, or "" when it can.
+// Outside free mode any model may be listed, as with single model names.
+func (s *server) chainCandidate(model string, req ChatRequest) string {
+	if s.freeMode && !s.models.Routable(model) {
+		return "not offered"
+	}
+	if s.freeMode && !s.isEligibleFreeModel(model, req) {
+		return "cannot serve this request"
+	}
+	skip, err := s.store.ShouldSkip(model)
+	if err != nil {
+		slog.Error("db error", "error", err)
+		return "failure state unknown"
+	}
+	if skip {
+		return "benched after recent failures"
+	}
+	return ""
+}
+
+// chainError reports that no model of a fallback chain could serve a request;
+// the proxy refuses rather than substituting a model the client did not list
+func chainError(failures []string) error {
+	return fmt.Errorf("no model in the fallback chain is available: %s", strings.Join(failures, "; "))
+}
+
+// getChainChat runs req on the first model of chain that succeeds
+func (s *server) getChainChat(ctx context.Context, req ChatRequest, chain []string) (openai.ChatCompletionResponse, string, error) {
+	var resp openai.ChatCompletionResponse
+	req = withoutChainFields(req)
+	var failures []string
+	for _, m := range chain {
+		if reason := s.chainCandidate(m, req); reason != "" {
+			failures = append(failures, m+": "+reason)
+			continue
+		}
+		var err error
+		resp, err = s.recordedChat(ctx, req, m)
+		if isCancelled(ctx, err) {
+			slog.Info("request cancelled by client", "model", m)
+			return resp, "", ctx.Err()
+		}
+		var outErr *outputError
+		if err != nil && !errors.As(err, &outErr) {
+			slog.Warn("fallback chain model failed", "model", m, "error", err)
+			_ = s.store.MarkFailure(m, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", m, err))
+			continue
+		}
+		_ = s.store.ClearFailure(m)
+		if outErr != nil {
+			slog.Warn("fallback chain model returned non-conforming structured output", "model", m, "error", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", m, err))
+			continue
+		}
+		return resp, m, nil
+	}
+	return resp, "", chainError(failures)
+}
+
+// getChainStream opens a stream on the first model of chain that accepts
+// it, skipping the models in exclude
+func (s *server) getChainStream(ctx context.Context, req ChatRequest, chain []string, exclude map[string]bool) (chatStream, string, error) {
+	req = withoutChainFields(req)
+	var failures []string
+	for _, m := range chain {
+		if exclude[m] {
+			failures = append(failures, m+": failed during this request")
+			continue
+		}
+		if reason := s.chainCandidate(m, req); reason != "" {
+			failures = append(failures, m+": "+reason)
+			continue
+		}
+		stream, err := s.openStream(ctx, req, m)
+		if isCancelled(ctx, err) {
+			slog.Info("request cancelled by client", "model", m)
+			return nil, "", ctx.Err()
+		}
+		if err != nil {
+			slog.Warn("fallback chain model failed", "model", m, "error", err)
+			_ = s.store.MarkFailure(m, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", m, err))
+			continue
+		}
+		_ = s.store.ClearFailure(m)
+		return stream, m, nil
+	}
+	return nil, "", chainError(failures)
+}
+
+// resumeStream opens a stream on another model after the ones in exclude
+// failed mid-stream, staying within the client's fallback chain or virtual
+// model. A model of another provider is not replaced by an OpenRouter one.
+func (s *server) resumeStream(ctx context.Context, req ChatRequest, requestedModel string, exclude map[string]bool) (chatStream, string, error) {
+	if s.paid != nil {
+		// X-Model-Tier went out with the first model, so the stream must not
+		// continue on a paid model after the client was told it is free
+		exclude = maps.Clone(exclude)
+		for _, m := range s.paid.Models {
+			exclude[m] = true
+		}
+	}
+	if chain := s.fallbackChain(req, requestedModel); chain != nil {
+		return s.getChainStream(ctx, req, chain, exclude)
+	}
+	if model := s.models.Resolve(requestedModel); s.providers.Owner(model) != "" {
+		return nil, "", fmt.Errorf("%s is served by provider %q, which has no fallback", model, s.providers.Owner(model))
+	}
+	return s.getFreeStream(ctx, req, exclude, s.virtualModel(requestedModel))
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// maxContextSize caps the unpacked size of a client-supplied context
+const maxContextSize = 16 << 20
+
+// fimSystemPrompt turns a chat model into a fill-in-the-middle completer for
+// requests that carry a suffix
+const fimSystemPrompt = "You are a code completion engine. The user sends the text before the cursor in <prefix> and the text after it in <suffix>. Reply with only the text that belongs between them, without explanations or code fences."
+
+type generateRequest struct {
+	Model    string                     `json:"model"`
+	Prompt   string                     `json:"prompt"`
+	Suffix   string                     `json:"suffix"`
+	System   string                     `json:"system"`
+	Template string                     `json:"template"`
+	Context  []int                      `json:"context"`
+	Images   []string                   `json:"images"`
+	Format   json.RawMessage            `json:"format"`
+	Options  map[string]json.RawMessage `json:"options"`
+	Raw      bool                       `json:"raw"`
+	Stream   *bool                      `json:"stream"`
+}
+
+// handleGenerate implements Ollama's /api/generate on top of chat completions
+func (s *server) handleGenerate(c *gin.Context) {
+	timings := newOllamaTimings()
+	var request generateRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
+	if request.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model name is required"})
+		return
+	}
+
+	// An empty prompt only asks Ollama to load the model
+	if request.Prompt == "" && len(request.Images) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"model":       request.Model,
+			"created_at":  time.Now().Format(time.RFC3339),
+			"response":    "",
+			"done":        true,
+			"done_reason": "load",
+		})
+		return
+	}
+
+	history, err := decodeContext(request.Context)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	messages, err := generateMessages(request, history)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	chatReq := ChatRequest{ChatCompletionRequest: openai.ChatCompletionRequest{Messages: messages}}
+	unsupported, err := applyOllamaOptions(&chatReq, request.Options)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(unsupported) > 0 {
+		slog.Warn("Ignoring unsupported Ollama options", "model", request.Model, "options", unsupported)
+		c.Header("X-Unsupported-Options", strings.Join(unsupported, ","))
+	}
+	if chatReq.ResponseFormat, err = ollamaResponseFormat(request.Format); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Raw prompts bypass templating, so Ollama returns no context for them
+	contextFor := func(reply string) []int {
+		if request.Raw {
+			return nil
+		}
+		return encodeContext(append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reply}))
+	}
+
+	if request.Stream != nil && !*request.Stream {
+		response, fullModelName, err := s.chatForModel(c.Request.Context(), chatReq, request.Model)
+		var outErr *outputError
+		if errors.As(err, &outErr) {
+			slog.Error("Model returned non-conforming structured output", "model", fullModelName, "Error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to get generate response", "Error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(response.Choices) == 0 {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "No response from model"})
+			return
+		}
+
+		content := response.Choices[0].Message.Content
+		slog.Info("Used model", "model", fullModelName, "paid", s.paid.IsPaid(fullModelName))
+		final := timings.Stats(&response.Usage)
+		final["model"] = fullModelName
+		final["created_at"] = time.Now().Format(time.RFC3339)
+		final["response"] = content
+		final["done"] = true
+		final["done_reason"] = ollamaDoneReason(string(response.Choices[0].FinishReason))
+		final["context"] = contextFor(content)
+		s.setModelTier(c, fullModelName)
+		c.JSON(http.StatusOK, final)
+		return
+	}
+
+	// Ask for a trailing usage chunk so the final message can report token counts
+	chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	stream, fullModelName, err := s.chatStreamForModel(c.Request.Context(), chatReq, request.Model)
+	if err != nil {
+		slog.Error("Failed to create generate stream", "Error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	upstream := newFailoverStream(c.Request.Context(), s, chatReq, stream, fullModelName, request.Model)
+	defer upstream.Close()
+	timings.Opened()
+	slog.Info("Using model", "fullModelName", fullModelName, "paid", s.paid.IsPaid(fullModelName))
+	s.setModelTier(c, fullModelName)
+
+	c.Writer.Header().Set("Content-Type", "application/x-ndjson")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+
+	w := c.Writer
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("Expected http.ResponseWriter to be an http.Flusher")
+		return
+	}
+	writeChunk := func(chunk gin.H) {
+		jsonData, err := json.Marshal(chunk)
+		if err != nil {
+			slog.Error("Error marshaling generate response JSON", "Error", err)
+			return
+		}
+		fmt.Fprintf(w, "%s\n", string(jsonData))
+		flusher.Flush()
+	}
+
+	var reply strings.Builder
+	var finishReason string
+	var usage *openai.Usage
+	for {
+		response, _, err := upstream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if isCancelled(c.Request.Context(), err) {
+			slog.Info("Client disconnected, upstream stream cancelled", "model", upstream.Model())
+			return
+		}
+		if err != nil {
+			slog.Error("Backend stream error", "Error", err)
+			writeChunk(gin.H{"error": "Stream error: " + err.Error()})
+			return
+		}
+		if response.Usage != nil {
+			usage = response.Usage
+		}
+		if len(response.Choices) == 0 {
+			continue
+		}
+		choice := response.Choices[0]
+		if choice.FinishReason != "" {
+			finishReason = string(choice.FinishReason)
+		}
+		if choice.Delta.Content == "" {
+			continue
+		}
+		timings.Token()
+		reply.WriteString(choice.Delta.Content)
+		writeChunk(gin.H{
+			"model":      upstream.Model(),
+			"created_at": time.Now().Format(time.RFC3339),
+			"response":   choice.Delta.Content,
+			"done":       false,
+		})
+	}
+
+	final := timings.Stats(usage)
+	final["model"] = upstream.Model()
+	final["created_at"] = time.Now().Format(time.RFC3339)
+	final["response"] = ""
+	final["done"] = true
+	final["done_reason"] = ollamaDoneReason(finishReason)
+	final["context"] = contextFor(reply.String())
+	writeChunk(final)
+}
+
+// generateMessages builds the chat messages for a generate request on top of
+// the conversation restored from its context
+func generateMessages(request generateRequest, history []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, error) {
+	prompt := request.Prompt
+	system := request.System
+
+	switch {
+	case request.Raw:
+		// Raw prompts are sent verbatim, without system prompt or history
+		history, system = nil, ""
+	case request.Suffix != "":
+		prompt = "<prefix>" + prompt + "</prefix><suffix>" + request.Suffix + "</suffix>"
+		system = fimSystemPrompt
+	case request.Template != "":
+		// A custom template renders the whole prompt, system message included
+		tmpl, err := template.New("prompt").Parse(request.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %w", err)
+		}
+		var rendered bytes.Buffer
+		data := map[string]string{"System": system, "Prompt": prompt, "Response": "", "Suffix": request.Suffix}
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return nil, fmt.Errorf("invalid template: %w", err)
+		}
+		prompt, system = rendered.String(), ""
+	}
+
+	messages := append([]openai.ChatCompletionMessage{}, history...)
+	if system != "" {
+		// The system prompt of this request replaces the one in the history
+		systemMessage := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: system}
+		if len(messages) > 0 && messages[0].Role == openai.ChatMessageRoleSystem {
+			messages[0] = systemMessage
+		} else {
+			messages = append([]openai.ChatCompletionMessage{systemMessage}, messages...)
+		}
+	}
+
+	user := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: prompt}
+	if len(request.Images) > 0 {
+		user.Content = ""
+		user.MultiContent = append([]openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: prompt}}, imageContentParts(request.Images)...)
+	}
+	return append(messages, user), nil
+}
+
+// encodeContext packs a conversation into Ollama's integer "context" array.
+// Ollama stores token IDs there; clients treat it as opaque, so the proxy
+// stores the deflated text-only conversation one byte per element instead.
+func encodeContext(messages []openai.ChatCompletionMessage) []int {
+	text := make([]openai.ChatCompletionMessage, 0, len(messages))
+	for _, m := range messages {
+		content := m.Content
+		for _, part := range m.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeText {
+				content += part.Text
+			}
+		}
+		text = append(text, openai.ChatCompletionMessage{Role: m.Role, Content: content})
+	}
+	data, err := json.Marshal(text)
+	if err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(data)
+	fw.Close()
+
+	context := make([]int, buf.Len())
+	for i, b := range buf.Bytes() {
+		context[i] = int(b)
+	}
+	return context
+}
+
+// decodeContext restores the conversation packed by encodeContext
+func decodeContext(context []int) ([]openai.ChatCompletionMessage, error) {
+	if len(context) == 0 {
+		return nil, nil
+	}
+	packed := make([]byte, len(context))
+	for i, v := range context {
+		if v < 0 || v > 255 {
+			return nil, errors.New("invalid context: not produced by this proxy")
+		}
+		packed[i] = byte(v)
+	}
+	// Deflate expands up to about 1000:1, so a small array must not be able
+	// to inflate without bound
+	data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(packed)), maxContextSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid context: %w", err)
+	}
+	if len(data) > maxContextSize {
+		return nil, fmt.Errorf("invalid context: larger than %d bytes unpacked", maxContextSize)
+	}
+	var messages []openai.ChatCompletionMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("invalid context: %w", err)
+	}
+	return messages, nil
+}
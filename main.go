@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,765 +17,611 @@ import (
 	openai "github.com/sashabaranov/go-openai"
 )
 
-var modelFilter map[string]struct{}
-var freeModels []string
-var failureStore *FailureStore
-var freeMode bool
+func main() {
+	// Load the API key from environment variables.
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		slog.Error("OPENAI_API_KEY environment variable not set.")
+		return
+	}
+
+	// FREE_MODE=hybrid is free mode with a capped fallback onto paid models
+	mode := strings.ToLower(os.Getenv("FREE_MODE"))
+	freeMode := mode != "false"
 
-func loadModelFilter(path string) (map[string]struct{}, error) {
-	file, err := os.Open(path)
+	// The store also keeps the attempt history, so it is opened in both modes
+	store, err := NewFailureStore("failures.db")
 	if err != nil {
-		return nil, err
+		slog.Error("failed to init failure store", "error", err)
+		return
 	}
-	defer file.Close()
+	defer store.Close()
+	go compactAttempts(store)
 
-	scanner := bufio.NewScanner(file)
-	filter := make(map[string]struct{})
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			filter[line] = struct{}{}
+	providers := newProviderSet(NewOpenrouterProvider(apiKey))
+	if err := loadProviders(providers); err != nil {
+		slog.Error("failed to configure providers", "error", err)
+		return
+	}
+	srv := newServer(providers, store, freeMode)
+	srv.fallbackModel = os.Getenv("FALLBACK_MODEL")
+	if mode == "hybrid" {
+		if srv.paid, err = loadPaidPolicy(); err != nil {
+			slog.Error("failed to configure hybrid mode", "error", err)
+			return
 		}
+		slog.Info("Hybrid mode enabled", "paidModels", srv.paid.Models, "dailyLimit", srv.paid.DailyLimit, "monthlyLimit", srv.paid.MonthlyLimit)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	// Every handler reads model metadata from this catalog; nothing fetches the
+	// OpenRouter model list per request
+	srv.refresher = newCatalogRefresher(providers, "models-cache.json", srv.models)
+	catalog, err := loadModelCatalog(providers.def, srv.refresher.cachePath)
+	switch {
+	case err == nil:
+	case freeMode:
+		slog.Error("failed to load model catalog", "error", err)
+		return
+	default:
+		// Requests still pass model names through; the refresher retries
+		slog.Warn("failed to load model catalog, starting with an empty one", "error", err)
+		catalog = newModelCatalog(nil, time.Time{})
+	}
+	if err := providers.CheckVendors(catalog); err != nil {
+		slog.Error("failed to configure providers", "error", err)
+		return
+	}
+	srv.models.Update(providers.withProviderModels(catalog, nil))
+	go srv.refresher.Run()
+	if freeMode {
+		slog.Info("Free mode enabled", "models", len(srv.models.FreeModels().IDs), "refreshInterval", srv.refresher.interval)
+	}
+
+	filterPath := os.Getenv("MODELS_FILTER_PATH")
+	if filterPath == "" {
+		filterPath = defaultFilterPath
+	}
+	filterWatcher := newFilterWatcher(filterPath, srv.models)
+	if err := filterWatcher.Reload(); err != nil {
+		slog.Error("Error loading models filter", "Error", err)
+		return
 	}
+	if !filterWatcher.present {
+		slog.Info("models-filter file not found. Skipping model filtering.", "path", filterPath)
+	}
+	// Edits to the filter apply without a restart
+	go filterWatcher.Run()
 
-	return filter, nil
+	srv.routes().Run(":11434")
 }
 
-func main() {
-	r := gin.Default()
-	// Load the API key from environment variables.
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		slog.Error("OPENAI_API_KEY environment variable not set.")
-		return
+// handleTags lists the models in Ollama format
+func (s *server) handleTags(c *gin.Context) {
+	newModels := []Model{}
+	fetched := s.models.Catalog().FetchedAt
+	for _, m := range s.models.List() {
+		newModels = append(newModels, ollamaModel(m.Info, m.Name, fetched))
 	}
+	c.JSON(http.StatusOK, gin.H{"models": newModels})
+}
 
-	freeMode = strings.ToLower(os.Getenv("FREE_MODE")) != "false"
+// handleShow describes one model from the catalog
+func (s *server) handleShow(c *gin.Context) {
+	var request struct {
+		Name    string `json:"name"`
+		Model   string `json:"model"`
+		Verbose bool   `json:"verbose"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
 
-	if freeMode {
-		var err error
-		freeModels, err = ensureFreeModelFile(apiKey, "free-models")
-		if err != nil {
-			slog.Error("failed to load free models", "error", err)
-			return
-		}
-		failureStore, err = NewFailureStore("failures.db")
-		if err != nil {
-			slog.Error("failed to init failure store", "error", err)
-			return
-		}
-		defer failureStore.Close()
-		slog.Info("Free mode enabled", "models", len(freeModels))
+	// Newer Ollama clients send "model", older ones "name"
+	modelName := request.Model
+	if modelName == "" {
+		modelName = request.Name
+	}
+	if modelName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model name is required"})
+		return
+	}
+	catalog := s.models.Catalog()
+	if v := s.virtualModel(modelName); v != nil {
+		c.JSON(http.StatusOK, showResponse(v.info(s.models.VirtualCandidates(v)), catalog.FetchedAt))
+		return
+	}
+	m, ok := catalog.Lookup(s.models.Resolve(modelName))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", modelName)})
+		return
 	}
 
-	provider := NewOpenrouterProvider(apiKey)
+	c.JSON(http.StatusOK, showResponse(m, catalog.FetchedAt))
+}
 
-	filter, err := loadModelFilter("/models-filter/filter")
-	if err != nil {
-		if os.IsNotExist(err) {
-			slog.Info("models-filter file not found. Skipping model filtering.")
-			modelFilter = make(map[string]struct{})
-		} else {
-			slog.Error("Error loading models filter", "Error", err)
-			return
-		}
-	} else {
-		modelFilter = filter
-		slog.Info("Loaded models from filter:")
-		for model := range modelFilter {
-			slog.Info(" - " + model)
-		}
+// handleChat implements Ollama's /api/chat
+func (s *server) handleChat(c *gin.Context) {
+	var request struct {
+		Model    string                     `json:"model"`
+		Messages []OllamaMessage            `json:"messages"`
+		Stream   *bool                      `json:"stream"` // Добавим поле Stream
+		Options  map[string]json.RawMessage `json:"options"`
+		Tools    []openai.Tool              `json:"tools"`
+		Format   json.RawMessage            `json:"format"`
 	}
 
-	r.GET("/", func(c *gin.Context) {
-		c.String(http.StatusOK, "Ollama is running")
-	})
-	r.HEAD("/", func(c *gin.Context) {
-		c.String(http.StatusOK, "")
-	})
+	timings := newOllamaTimings()
 
-	r.GET("/api/tags", func(c *gin.Context) {
-		var newModels []map[string]interface{}
-		
-		// Check if tool use filtering is enabled
-		toolUseOnly := strings.ToLower(os.Getenv("TOOL_USE_ONLY")) == "true"
-
-		if freeMode {
-			// In free mode, show only available free models
-			currentTime := time.Now().Format(time.RFC3339)
-			for _, freeModel := range freeModels {
-				// Check if model should be skipped due to recent failures
-				skip, err := failureStore.ShouldSkip(freeModel)
-				if err != nil {
-					slog.Error("db error checking model", "model", freeModel, "error", err)
-					continue
-				}
-				if skip {
-					continue // Skip recently failed models
-				}
+	// Parse the JSON request
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
 
-				// Extract display name from full model name
-				parts := strings.Split(freeModel, "/")
-				displayName := parts[len(parts)-1]
+	chatReq := ChatRequest{ChatCompletionRequest: openai.ChatCompletionRequest{
+		Messages: toOpenAIMessages(request.Messages),
+		Tools:    request.Tools,
+	}}
+	unsupported, err := applyOllamaOptions(&chatReq, request.Options)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(unsupported) > 0 {
+		slog.Warn("Ignoring unsupported Ollama options", "model", request.Model, "options", unsupported)
+		c.Header("X-Unsupported-Options", strings.Join(unsupported, ","))
+	}
+	if chatReq.ResponseFormat, err = ollamaResponseFormat(request.Format); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-				// Apply model filter if it exists
-				if !isModelInFilter(displayName, modelFilter) {
-					continue // Skip models not in filter
-				}
+	// Определяем, нужен ли стриминг (по умолчанию true, если не указано для /api/chat)
+	// ВАЖНО: Open WebUI может НЕ передавать "stream": true для /api/chat, подразумевая это.
+	// Нужно проверить, какой запрос шлет Open WebUI. Если не шлет, ставим true.
+	streamRequested := true
+	if request.Stream != nil {
+		streamRequested = *request.Stream
+	}
 
-				newModels = append(newModels, map[string]interface{}{
-					"name":        displayName,
-					"model":       displayName,
-					"modified_at": currentTime,
-					"size":        270898672,
-					"digest":      "9077fe9d2ae1a4a41a868836b56b8163731a8fe16621397028c2c76f838c6907",
-					"details": map[string]interface{}{
-						"parent_model":       "",
-						"format":             "gguf",
-						"family":             "free",
-						"families":           []string{"free"},
-						"parameter_size":     "varies",
-						"quantization_level": "Q4_K_M",
-					},
-				})
+	// Если стриминг не запрошен, нужно будет реализовать отдельную логику
+	// для сбора полного ответа и отправки его одним JSON.
+	// Пока реализуем только стриминг.
+	if !streamRequested {
+		var response openai.ChatCompletionResponse
+		var fullModelName string
+		var err error
+		if s.freeMode {
+			response, fullModelName, err = s.getFreeChatForModel(c.Request.Context(), chatReq, request.Model)
+			if err != nil {
+				slog.Error("free mode failed", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
 			}
 		} else {
-			// Non-free mode: use original logic
-			if toolUseOnly {
-				// If tool use filtering is enabled, we need to fetch full model details from OpenRouter
-				req, err := http.NewRequest("GET", "https://openrouter.ai/api/v1/models", nil)
-				if err != nil {
-					slog.Error("Error creating request for models", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENAI_API_KEY"))
-				
-				resp, err := http.DefaultClient.Do(req)
-				if err != nil {
-					slog.Error("Error fetching models from OpenRouter", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				defer resp.Body.Close()
-				
-				if resp.StatusCode != http.StatusOK {
-					slog.Error("Unexpected status from OpenRouter", "status", resp.Status)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch models"})
-					return
-				}
-				
-				var result orModels
-				if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-					slog.Error("Error decoding models response", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				
-				// Filter models based on tool use support and model filter
-				currentTime := time.Now().Format(time.RFC3339)
-				newModels = make([]map[string]interface{}, 0, len(result.Data))
-				for _, m := range result.Data {
-					if !supportsToolUse(m.SupportedParameters) {
-						continue // Skip models that don't support tool use
-					}
-					
-					// Extract display name from full model name
-					parts := strings.Split(m.ID, "/")
-					displayName := parts[len(parts)-1]
-					
-					// Apply model filter if it exists
-					if !isModelInFilter(displayName, modelFilter) {
-						continue // Skip models not in filter
-					}
-					
-					newModels = append(newModels, map[string]interface{}{
-						"name":        displayName,
-						"model":       displayName,
-						"modified_at": currentTime,
-						"size":        270898672,
-						"digest":      "9077fe9d2ae1a4a41a868836b56b8163731a8fe16621397028c2c76f838c6907",
-						"details": map[string]interface{}{
-							"parent_model":       "",
-							"format":             "gguf",
-							"family":             "tool-enabled",
-							"families":           []string{"tool-enabled"},
-							"parameter_size":     "varies",
-							"quantization_level": "Q4_K_M",
-						},
-					})
-				}
-			} else {
-				// Standard non-free mode: get all models from provider
-				models, err := provider.GetModels()
-				if err != nil {
-					slog.Error("Error getting models", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				filter := modelFilter
-				newModels = make([]map[string]interface{}, 0, len(models))
-				for _, m := range models {
-					// Если фильтр пустой, значит пропускаем проверку и берём все модели
-					if len(filter) > 0 {
-						if _, ok := filter[m.Model]; !ok {
-							continue
-						}
-					}
-					newModels = append(newModels, map[string]interface{}{
-						"name":        m.Name,
-						"model":       m.Model,
-						"modified_at": m.ModifiedAt,
-						"size":        270898672,
-						"digest":      "9077fe9d2ae1a4a41a868836b56b8163731a8fe16621397028c2c76f838c6907",
-						"details":     m.Details,
-					})
-				}
+			response, fullModelName, err = s.directChat(c.Request.Context(), chatReq, request.Model)
+			var outErr *outputError
+			if errors.As(err, &outErr) {
+				slog.Error("Model returned non-conforming structured output", "model", fullModelName, "Error", err)
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				slog.Error("Failed to get chat response", "Error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
 			}
 		}
 
-		c.JSON(http.StatusOK, gin.H{"models": newModels})
-	})
-
-	r.POST("/api/show", func(c *gin.Context) {
-		var request map[string]string
-		if err := c.BindJSON(&request); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		// Format the response according to Ollama's format
+		if len(response.Choices) == 0 {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "No response from model"})
 			return
 		}
 
-		modelName := request["name"]
-		if modelName == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Model name is required"})
-			return
+		// Extract the content from the response
+		content := ""
+		if len(response.Choices) > 0 && response.Choices[0].Message.Content != "" {
+			content = response.Choices[0].Message.Content
+		}
+
+		// Create Ollama-compatible response
+		ollamaResponse := timings.Stats(&response.Usage)
+		ollamaResponse["model"] = fullModelName
+		ollamaResponse["created_at"] = time.Now().Format(time.RFC3339)
+		ollamaResponse["message"] = OllamaMessage{
+			Role:      "assistant",
+			Content:   content,
+			ToolCalls: toOllamaToolCalls(response.Choices[0].Message.ToolCalls),
 		}
+		ollamaResponse["done"] = true
+		ollamaResponse["done_reason"] = ollamaDoneReason(string(response.Choices[0].FinishReason))
+
+		slog.Info("Used model", "model", fullModelName, "paid", s.paid.IsPaid(fullModelName))
 
-		details, err := provider.GetModelDetails(modelName)
+		s.setModelTier(c, fullModelName)
+		c.JSON(http.StatusOK, ollamaResponse)
+		return
+	}
+
+	slog.Info("Requested model", "model", request.Model)
+	// Ask for a trailing usage chunk so the final message can report token counts
+	chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	var stream chatStream
+	var fullModelName string
+	if s.freeMode {
+		stream, fullModelName, err = s.getFreeStreamForModel(c.Request.Context(), chatReq, request.Model)
+		if err != nil {
+			slog.Error("free mode failed", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		stream, fullModelName, err = s.directStream(c.Request.Context(), chatReq, request.Model)
 		if err != nil {
+			slog.Error("Failed to create stream", "Error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+	}
+	timings.Opened()
+	slog.Info("Using model", "fullModelName", fullModelName, "paid", s.paid.IsPaid(fullModelName))
+	s.setModelTier(c, fullModelName)
+	// Call ChatStream to get the stream
+	if err != nil {
+		slog.Error("Failed to create stream", "Error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	upstream := newFailoverStream(c.Request.Context(), s, chatReq, stream, fullModelName, request.Model)
+	defer upstream.Close() // Ensure stream closure
+
+	// --- ИСПРАВЛЕНИЯ для NDJSON (Ollama-style) ---
+
+	// Set headers CORRECTLY for Newline Delimited JSON
+	c.Writer.Header().Set("Content-Type", "application/x-ndjson") // <--- КЛЮЧЕВОЕ ИЗМЕНЕНИЕ
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	// Transfer-Encoding: chunked устанавливается Gin автоматически
+
+	w := c.Writer // Получаем ResponseWriter
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("Expected http.ResponseWriter to be an http.Flusher")
+		// Отправить ошибку клиенту уже сложно, т.к. заголовки могли уйти
+		return
+	}
 
-		c.JSON(http.StatusOK, details)
-	})
+	var lastFinishReason string
+	var toolCalls []openai.ToolCall
+	var usage *openai.Usage
 
-	r.POST("/api/chat", func(c *gin.Context) {
-		var request struct {
-			Model    string                         `json:"model"`
-			Messages []openai.ChatCompletionMessage `json:"messages"`
-			Stream   *bool                          `json:"stream"` // Добавим поле Stream
+	// Stream responses back to the client
+	for {
+		response, _, err := upstream.Recv()
+		if errors.Is(err, io.EOF) {
+			// End of stream from the backend provider
+			break
 		}
-
-		// Parse the JSON request
-		if err := c.ShouldBindJSON(&request); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		if isCancelled(c.Request.Context(), err) {
+			slog.Info("Client disconnected, upstream stream cancelled", "model", upstream.Model())
+			return
+		}
+		if err != nil {
+			slog.Error("Backend stream error", "Error", err)
+			// Попытка отправить ошибку в формате NDJSON
+			// Ollama обычно просто обрывает соединение или шлет 500 перед этим
+			errorMsg := map[string]string{"error": "Stream error: " + err.Error()}
+			errorJson, _ := json.Marshal(errorMsg)
+			fmt.Fprintf(w, "%s\n", string(errorJson)) // Отправляем ошибку + \n
+			flusher.Flush()
 			return
 		}
 
-		// Определяем, нужен ли стриминг (по умолчанию true, если не указано для /api/chat)
-		// ВАЖНО: Open WebUI может НЕ передавать "stream": true для /api/chat, подразумевая это.
-		// Нужно проверить, какой запрос шлет Open WebUI. Если не шлет, ставим true.
-		streamRequested := true
-		if request.Stream != nil {
-			streamRequested = *request.Stream
-		}
-
-		// Если стриминг не запрошен, нужно будет реализовать отдельную логику
-		// для сбора полного ответа и отправки его одним JSON.
-		// Пока реализуем только стриминг.
-		if !streamRequested {
-			var response openai.ChatCompletionResponse
-			var fullModelName string
-			var err error
-			if freeMode {
-				response, fullModelName, err = getFreeChatForModel(provider, request.Messages, request.Model)
-				if err != nil {
-					slog.Error("free mode failed", "error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-			} else {
-				fullModelName, err = provider.GetFullModelName(request.Model)
-				if err != nil {
-					slog.Error("Error getting full model name", "Error", err)
-					// Ollama returns 404 for invalid model names
-					c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-					return
-				}
-				response, err = provider.Chat(request.Messages, fullModelName)
-				if err != nil {
-					slog.Error("Failed to get chat response", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-			}
+		if response.Usage != nil {
+			usage = response.Usage
+		}
+		if len(response.Choices) == 0 {
+			continue // Usage-only chunks carry no message
+		}
+		choice := response.Choices[0]
+		if choice.Delta.Content != "" || len(choice.Delta.ToolCalls) > 0 {
+			timings.Token()
+		}
 
-			// Format the response according to Ollama's format
-			if len(response.Choices) == 0 {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "No response from model"})
-				return
-			}
+		// Сохраняем причину остановки, если она есть в чанке
+		if choice.FinishReason != "" {
+			lastFinishReason = string(choice.FinishReason)
+		}
 
-			// Extract the content from the response
-			content := ""
-			if len(response.Choices) > 0 && response.Choices[0].Message.Content != "" {
-				content = response.Choices[0].Message.Content
+		// Tool call arguments arrive in fragments, but Ollama clients expect
+		// complete calls, so hold them back until the stream ends
+		if len(choice.Delta.ToolCalls) > 0 {
+			toolCalls = accumulateToolCalls(toolCalls, choice.Delta.ToolCalls)
+			if choice.Delta.Content == "" {
+				continue
 			}
+		}
 
-			// Get finish reason, default to "stop" if not provided
-			finishReason := "stop"
-			if response.Choices[0].FinishReason != "" {
-				finishReason = string(response.Choices[0].FinishReason)
-			}
+		// Build JSON response structure for intermediate chunks (Ollama chat format)
+		responseJSON := map[string]interface{}{
+			"model":      upstream.Model(),
+			"created_at": time.Now().Format(time.RFC3339),
+			"message": OllamaMessage{
+				Role:    "assistant",
+				Content: choice.Delta.Content, // Может быть ""
+			},
+			"done": false, // Всегда false для промежуточных чанков
+		}
 
-			// Create Ollama-compatible response
-			ollamaResponse := map[string]interface{}{
-				"model":      fullModelName,
-				"created_at": time.Now().Format(time.RFC3339),
-				"message": map[string]string{
-					"role":    "assistant",
-					"content": content,
-				},
-				"done":              true,
-				"finish_reason":     finishReason,
-				"total_duration":    response.Usage.TotalTokens * 10, // Approximate duration based on token count
-				"load_duration":     0,
-				"prompt_eval_count": response.Usage.PromptTokens,
-				"eval_count":        response.Usage.CompletionTokens,
-				"eval_duration":     response.Usage.CompletionTokens * 10, // Approximate duration based on token count
-			}
+		// Marshal JSON
+		jsonData, err := json.Marshal(responseJSON)
+		if err != nil {
+			slog.Error("Error marshaling intermediate response JSON", "Error", err)
+			return // Прерываем, так как не можем отправить данные
+		}
+
+		// Send JSON object followed by a newline
+		fmt.Fprintf(w, "%s\n", string(jsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON (JSON + \n)
 
-			slog.Info("Used model", "model", fullModelName)
+		// Flush data to send it immediately
+		flusher.Flush()
+	}
 
-			c.JSON(http.StatusOK, ollamaResponse)
+	if len(toolCalls) > 0 {
+		toolCallJSON, err := json.Marshal(map[string]interface{}{
+			"model":      upstream.Model(),
+			"created_at": time.Now().Format(time.RFC3339),
+			"message": OllamaMessage{
+				Role:      "assistant",
+				ToolCalls: toOllamaToolCalls(toolCalls),
+			},
+			"done": false,
+		})
+		if err != nil {
+			slog.Error("Error marshaling tool call response JSON", "Error", err)
 			return
 		}
+		fmt.Fprintf(w, "%s\n", string(toolCallJSON))
+		flusher.Flush()
+	}
+
+	// --- Отправка финального сообщения (done: true) в стиле Ollama ---
+
+	// Статистика: реальные длительности в наносекундах и токены из usage-чанка
+	finalResponse := timings.Stats(usage)
+	finalResponse["model"] = upstream.Model()
+	finalResponse["created_at"] = time.Now().Format(time.RFC3339)
+	finalResponse["message"] = OllamaMessage{
+		Role:    "assistant",
+		Content: "", // Пустой контент для финального сообщения
+	}
+	finalResponse["done"] = true
+	finalResponse["done_reason"] = ollamaDoneReason(lastFinishReason) // Ollama использует 'stop' и 'length'
+
+	finalJsonData, err := json.Marshal(finalResponse)
+	if err != nil {
+		slog.Error("Error marshaling final response JSON", "Error", err)
+		return
+	}
+
+	// Отправляем финальный JSON-объект + newline
+	fmt.Fprintf(w, "%s\n", string(finalJsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON
+	flusher.Flush()
+
+	// ВАЖНО: Для NDJSON НЕТ 'data: [DONE]' маркера.
+	// Клиент понимает конец потока по получению объекта с "done": true
+	// и/или по закрытию соединения сервером (что Gin сделает автоматически после выхода из хендлера).
+
+	// --- Конец исправлений ---
+}
+
+// handleOpenAIChat is the OpenAI-compatible chat endpoint for tools like Goose
+func (s *server) handleOpenAIChat(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "Invalid JSON payload"}})
+		return
+	}
+	request, err := parseChatRequest(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error()}})
+		return
+	}
 
-		slog.Info("Requested model", "model", request.Model)
-		var stream *openai.ChatCompletionStream
+	slog.Info("OpenAI API request", "model", request.Model, "stream", request.Stream)
+
+	if request.Stream {
+		// Handle streaming request
+		var stream chatStream
 		var fullModelName string
 		var err error
-		if freeMode {
-			stream, fullModelName, err = getFreeStreamForModel(provider, request.Messages, request.Model)
+
+		// Usage is always requested so attempts and paid spend get token
+		// counts; the trailing usage chunk is only passed on if asked for
+		clientUsage := request.StreamOptions != nil && request.StreamOptions.IncludeUsage
+		request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+		if s.freeMode {
+			stream, fullModelName, err = s.getFreeStreamForModel(c.Request.Context(), request, request.Model)
 			if err != nil {
-				slog.Error("free mode failed", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				slog.Error("free mode streaming failed", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 				return
 			}
 		} else {
-			fullModelName, err = provider.GetFullModelName(request.Model)
-			if err != nil {
-				slog.Error("Error getting full model name", "Error", err, "model", request.Model)
-				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-				return
-			}
-			stream, err = provider.ChatStream(request.Messages, fullModelName)
+			stream, fullModelName, err = s.directStream(c.Request.Context(), request, request.Model)
 			if err != nil {
 				slog.Error("Failed to create stream", "Error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 				return
 			}
 		}
-		slog.Info("Using model", "fullModelName", fullModelName)
-		// Call ChatStream to get the stream
-		if err != nil {
-			slog.Error("Failed to create stream", "Error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		defer stream.Close() // Ensure stream closure
+		upstream := newFailoverStream(c.Request.Context(), s, request, stream, fullModelName, request.Model)
+		defer upstream.Close()
+		slog.Info("Using model", "fullModelName", fullModelName, "paid", s.paid.IsPaid(fullModelName))
+		s.setModelTier(c, fullModelName)
 
-		// --- ИСПРАВЛЕНИЯ для NDJSON (Ollama-style) ---
-
-		// Set headers CORRECTLY for Newline Delimited JSON
-		c.Writer.Header().Set("Content-Type", "application/x-ndjson") // <--- КЛЮЧЕВОЕ ИЗМЕНЕНИЕ
+		// Set headers for Server-Sent Events (OpenAI format)
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
 		c.Writer.Header().Set("Cache-Control", "no-cache")
 		c.Writer.Header().Set("Connection", "keep-alive")
-		// Transfer-Encoding: chunked устанавливается Gin автоматически
 
-		w := c.Writer // Получаем ResponseWriter
+		w := c.Writer
 		flusher, ok := w.(http.Flusher)
 		if !ok {
 			slog.Error("Expected http.ResponseWriter to be an http.Flusher")
-			// Отправить ошибку клиенту уже сложно, т.к. заголовки могли уйти
 			return
 		}
 
-		var lastFinishReason string
-
-		// Stream responses back to the client
+		// Stream responses in OpenAI format, passing upstream chunks through
+		rewriter := newStreamChunkRewriter(fullModelName)
 		for {
-			response, err := stream.Recv()
+			response, raw, err := upstream.Recv()
 			if errors.Is(err, io.EOF) {
-				// End of stream from the backend provider
+				// Send final [DONE] message
+				fmt.Fprintf(w, "data: [DONE]\n\n")
+				flusher.Flush()
+				break
+			}
+			if isCancelled(c.Request.Context(), err) {
+				slog.Info("Client disconnected, upstream stream cancelled", "model", upstream.Model())
 				break
 			}
 			if err != nil {
-				slog.Error("Backend stream error", "Error", err)
-				// Попытка отправить ошибку в формате NDJSON
-				// Ollama обычно просто обрывает соединение или шлет 500 перед этим
-				errorMsg := map[string]string{"error": "Stream error: " + err.Error()}
-				errorJson, _ := json.Marshal(errorMsg)
-				fmt.Fprintf(w, "%s\n", string(errorJson)) // Отправляем ошибку + \n
+				slog.Error("Stream error", "Error", err)
+				errorJSON, _ := json.Marshal(gin.H{"error": gin.H{"message": "Stream error: " + err.Error()}})
+				fmt.Fprintf(w, "data: %s\n\n", string(errorJSON))
 				flusher.Flush()
-				return
-			}
-
-			// Сохраняем причину остановки, если она есть в чанке
-			if len(response.Choices) > 0 && response.Choices[0].FinishReason != "" {
-				lastFinishReason = string(response.Choices[0].FinishReason)
+				break
 			}
 
-			// Build JSON response structure for intermediate chunks (Ollama chat format)
-			responseJSON := map[string]interface{}{
-				"model":      fullModelName,
-				"created_at": time.Now().Format(time.RFC3339),
-				"message": map[string]string{
-					"role":    "assistant",
-					"content": response.Choices[0].Delta.Content, // Может быть ""
-				},
-				"done": false, // Всегда false для промежуточных чанков
+			if !clientUsage && len(response.Choices) == 0 && response.Usage != nil {
+				continue
 			}
 
-			// Marshal JSON
-			jsonData, err := json.Marshal(responseJSON)
+			rewriter.model = upstream.Model()
+			jsonData, err := rewriter.Rewrite(raw)
 			if err != nil {
-				slog.Error("Error marshaling intermediate response JSON", "Error", err)
-				return // Прерываем, так как не можем отправить данные
+				slog.Error("Error rewriting stream chunk", "Error", err)
+				break
 			}
 
-			// Send JSON object followed by a newline
-			fmt.Fprintf(w, "%s\n", string(jsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON (JSON + \n)
-
-			// Flush data to send it immediately
+			fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
 			flusher.Flush()
 		}
+	} else {
+		// Handle non-streaming request
+		var response openai.ChatCompletionResponse
+		var fullModelName string
+		var err error
 
-		// --- Отправка финального сообщения (done: true) в стиле Ollama ---
-
-		// Определяем причину остановки (если бэкенд не дал, ставим 'stop')
-		// Ollama использует 'stop', 'length', 'content_filter', 'tool_calls'
-		if lastFinishReason == "" {
-			lastFinishReason = "stop"
-		}
-
-		// ВАЖНО: Замените nil на 0 для числовых полей статистики
-		finalResponse := map[string]interface{}{
-			"model":      fullModelName,
-			"created_at": time.Now().Format(time.RFC3339),
-			"message": map[string]string{
-				"role":    "assistant",
-				"content": "", // Пустой контент для финального сообщения
-			},
-			"done":              true,
-			"finish_reason":     lastFinishReason, // Необязательно для /api/chat Ollama, но не вредит
-			"total_duration":    0,
-			"load_duration":     0,
-			"prompt_eval_count": 0, // <--- ИЗМЕНЕНО: nil заменен на 0
-			"eval_count":        0, // <--- ИЗМЕНЕНО: nil заменен на 0
-			"eval_duration":     0,
-		}
-
-		finalJsonData, err := json.Marshal(finalResponse)
-		if err != nil {
-			slog.Error("Error marshaling final response JSON", "Error", err)
-			return
-		}
-
-		// Отправляем финальный JSON-объект + newline
-		fmt.Fprintf(w, "%s\n", string(finalJsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON
-		flusher.Flush()
-
-		// ВАЖНО: Для NDJSON НЕТ 'data: [DONE]' маркера.
-		// Клиент понимает конец потока по получению объекта с "done": true
-		// и/или по закрытию соединения сервером (что Gin сделает автоматически после выхода из хендлера).
-
-		// --- Конец исправлений ---
-	})
-
-	// Add OpenAI-compatible endpoint for tools like Goose
-	r.POST("/v1/chat/completions", func(c *gin.Context) {
-		var request openai.ChatCompletionRequest
-		if err := c.ShouldBindJSON(&request); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
-			return
-		}
-
-		slog.Info("OpenAI API request", "model", request.Model, "stream", request.Stream)
-
-		if request.Stream {
-			// Handle streaming request
-			var stream *openai.ChatCompletionStream
-			var fullModelName string
-			var err error
-
-			if freeMode {
-				stream, fullModelName, err = getFreeStreamForModel(provider, request.Messages, request.Model)
-				if err != nil {
-					slog.Error("free mode streaming failed", "error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-			} else {
-				fullModelName, err = provider.GetFullModelName(request.Model)
-				if err != nil {
-					slog.Error("Error getting full model name", "Error", err, "model", request.Model)
-					c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-				stream, err = provider.ChatStream(request.Messages, fullModelName)
-				if err != nil {
-					slog.Error("Failed to create stream", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-			}
-			defer stream.Close()
-
-			// Set headers for Server-Sent Events (OpenAI format)
-			c.Writer.Header().Set("Content-Type", "text/event-stream")
-			c.Writer.Header().Set("Cache-Control", "no-cache")
-			c.Writer.Header().Set("Connection", "keep-alive")
-
-			w := c.Writer
-			flusher, ok := w.(http.Flusher)
-			if !ok {
-				slog.Error("Expected http.ResponseWriter to be an http.Flusher")
+		if s.freeMode {
+			response, fullModelName, err = s.getFreeChatForModel(c.Request.Context(), request, request.Model)
+			if err != nil {
+				slog.Error("free mode failed", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
 				return
 			}
-
-			// Stream responses in OpenAI format
-			for {
-				response, err := stream.Recv()
-				if errors.Is(err, io.EOF) {
-					// Send final [DONE] message
-					fmt.Fprintf(w, "data: [DONE]\n\n")
-					flusher.Flush()
-					break
-				}
-				if err != nil {
-					slog.Error("Stream error", "Error", err)
-					break
-				}
-
-				// Convert to OpenAI response format
-				openaiResponse := openai.ChatCompletionStreamResponse{
-					ID:      "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix()),
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   fullModelName,
-					Choices: []openai.ChatCompletionStreamChoice{
-						{
-							Index: 0,
-							Delta: openai.ChatCompletionStreamChoiceDelta{
-								Content: response.Choices[0].Delta.Content,
-							},
-						},
-					},
-				}
-
-				// Add finish reason if present
-				if len(response.Choices) > 0 && response.Choices[0].FinishReason != "" {
-					openaiResponse.Choices[0].FinishReason = response.Choices[0].FinishReason
-				}
-
-				jsonData, err := json.Marshal(openaiResponse)
-				if err != nil {
-					slog.Error("Error marshaling response", "Error", err)
-					break
-				}
-
-				fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
-				flusher.Flush()
-			}
 		} else {
-			// Handle non-streaming request
-			var response openai.ChatCompletionResponse
-			var fullModelName string
-			var err error
-
-			if freeMode {
-				response, fullModelName, err = getFreeChatForModel(provider, request.Messages, request.Model)
-				if err != nil {
-					slog.Error("free mode failed", "error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-			} else {
-				fullModelName, err = provider.GetFullModelName(request.Model)
-				if err != nil {
-					slog.Error("Error getting full model name", "Error", err)
-					c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-				response, err = provider.Chat(request.Messages, fullModelName)
-				if err != nil {
-					slog.Error("Failed to get chat response", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
+			response, fullModelName, err = s.directChat(c.Request.Context(), request, request.Model)
+			var outErr *outputError
+			if errors.As(err, &outErr) {
+				slog.Error("Model returned non-conforming structured output", "model", fullModelName, "Error", err)
+				c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{"message": err.Error()}})
+				return
 			}
-
-			// Return OpenAI-compatible response
-			response.ID = "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix())
-			response.Object = "chat.completion"
-			response.Created = time.Now().Unix()
-			response.Model = fullModelName
-
-			slog.Info("Used model", "model", fullModelName)
-			c.JSON(http.StatusOK, response)
-		}
-	})
-
-	// Add OpenAI-compatible models endpoint
-	r.GET("/v1/models", func(c *gin.Context) {
-		var models []gin.H
-		
-		// Check if tool use filtering is enabled
-		toolUseOnly := strings.ToLower(os.Getenv("TOOL_USE_ONLY")) == "true"
-
-		if freeMode {
-			// In free mode, show only available free models
-			slog.Info("Free mode enabled for /v1/models", "totalFreeModels", len(freeModels), "filterSize", len(modelFilter))
-			if len(freeModels) > 0 {
-				slog.Info("Sample free models:", "first", freeModels[0], "count", min(len(freeModels), 3))
+			if err != nil {
+				slog.Error("Failed to get chat response", "Error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
+				return
 			}
-			for _, freeModel := range freeModels {
-				skip, err := failureStore.ShouldSkip(freeModel)
-				if err != nil {
-					slog.Error("db error checking model", "model", freeModel, "error", err)
-					continue
-				}
-				if skip {
-					continue
-				}
-
-				parts := strings.Split(freeModel, "/")
-				displayName := parts[len(parts)-1]
+		}
 
-				// Apply model filter if it exists
-				if !isModelInFilter(displayName, modelFilter) {
-					slog.Info("Skipping model not in filter", "displayName", displayName, "fullModel", freeModel)
-					continue // Skip models not in filter
-				}
-				if len(modelFilter) > 0 {
-					slog.Info("Model passed filter", "displayName", displayName, "fullModel", freeModel)
-				}
+		// Return OpenAI-compatible response
+		response.ID = "chatcmpl-" + fmt.Sprintf("%d", time.Now().Unix())
+		response.Object = "chat.completion"
+		response.Created = time.Now().Unix()
+		response.Model = fullModelName
 
-				slog.Debug("Adding model to /v1/models", "model", displayName, "fullModel", freeModel)
-				models = append(models, gin.H{
-					"id":       displayName,
-					"object":   "model",
-					"created":  time.Now().Unix(),
-					"owned_by": "openrouter",
-				})
-			}
-		} else {
-			// Non-free mode: get all models from provider
-			if toolUseOnly {
-				// If tool use filtering is enabled, we need to fetch full model details from OpenRouter
-				req, err := http.NewRequest("GET", "https://openrouter.ai/api/v1/models", nil)
-				if err != nil {
-					slog.Error("Error creating request for models", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-				req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENAI_API_KEY"))
-				
-				resp, err := http.DefaultClient.Do(req)
-				if err != nil {
-					slog.Error("Error fetching models from OpenRouter", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-				defer resp.Body.Close()
-				
-				if resp.StatusCode != http.StatusOK {
-					slog.Error("Unexpected status from OpenRouter", "status", resp.Status)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": "Failed to fetch models"}})
-					return
-				}
-				
-				var result orModels
-				if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-					slog.Error("Error decoding models response", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
-				
-				// Filter models based on tool use support and model filter
-				for _, m := range result.Data {
-					if !supportsToolUse(m.SupportedParameters) {
-						continue // Skip models that don't support tool use
-					}
-					
-					// Extract display name from full model name
-					parts := strings.Split(m.ID, "/")
-					displayName := parts[len(parts)-1]
-					
-					// Apply model filter if it exists
-					if !isModelInFilter(displayName, modelFilter) {
-						continue // Skip models not in filter
-					}
-					
-					models = append(models, gin.H{
-						"id":       displayName,
-						"object":   "model",
-						"created":  time.Now().Unix(),
-						"owned_by": "openrouter",
-					})
-				}
-			} else {
-				// Standard non-free mode: get all models from provider
-				providerModels, err := provider.GetModels()
-				if err != nil {
-					slog.Error("Error getting models", "Error", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": err.Error()}})
-					return
-				}
+		slog.Info("Used model", "model", fullModelName, "paid", s.paid.IsPaid(fullModelName))
+		s.setModelTier(c, fullModelName)
+		c.JSON(http.StatusOK, response)
+	}
+}
 
-				for _, m := range providerModels {
-					if len(modelFilter) > 0 {
-						if _, ok := modelFilter[m.Model]; !ok {
-							continue
-						}
-					}
-					models = append(models, gin.H{
-						"id":       m.Model,
-						"object":   "model",
-						"created":  time.Now().Unix(),
-						"owned_by": "openrouter",
-					})
-				}
-			}
-		}
+// handleOpenAIModels lists the models in OpenAI format
+func (s *server) handleOpenAIModels(c *gin.Context) {
+	models := []map[string]interface{}{}
+	fetched := s.models.Catalog().FetchedAt
+	for _, m := range s.models.List() {
+		models = append(models, openAIModel(m.Info, m.Name, fetched))
+	}
 
-		slog.Info("Returning models response", "modelCount", len(models))
-		c.JSON(http.StatusOK, gin.H{
-			"object": "list",
-			"data":   models,
-		})
+	slog.Info("Returning models response", "modelCount", len(models))
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   models,
 	})
+}
+
+// handleRefreshModels re-fetches the model catalog now instead of waiting
+// for the next refresh
+func (s *server) handleRefreshModels(c *gin.Context) {
+	result, err := s.refresher.Refresh()
+	if err != nil {
+		slog.Error("Forced model catalog refresh failed", "Error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
 
-	r.Run(":11434")
+// handleModelStats reports per-model health over a sliding window, e.g.
+// /api/model-stats?window=1h
+func (s *server) handleModelStats(c *gin.Context) {
+	window := 24 * time.Hour
+	if w := c.Query("window"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid window"})
+			return
+		}
+		window = d
+	}
+	stats, err := s.store.ModelStats(window)
+	if err != nil {
+		slog.Error("Error computing model stats", "Error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	models := make([]ModelStats, 0, len(stats))
+	for _, m := range stats {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Model < models[j].Model })
+	c.JSON(http.StatusOK, gin.H{"window": window.String(), "models": models})
 }
 
-func getFreeChat(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage) (openai.ChatCompletionResponse, string, error) {
+// getFreeChat runs req on the first free model that succeeds, skipping the
+// models in exclude, in the order of the virtual model v when it is set
+func (s *server) getFreeChat(ctx context.Context, req ChatRequest, exclude map[string]bool, v *virtualModel) (openai.ChatCompletionResponse, string, error) {
 	var resp openai.ChatCompletionResponse
-	for _, m := range freeModels {
+	needsVision := requestHasImages(req)
+	for _, m := range s.freeCandidates(v) {
+		if exclude[m] {
+			continue // Already failed during this request
+		}
 		// Apply model filter if it exists
-		parts := strings.Split(m, "/")
-		displayName := parts[len(parts)-1]
-		if !isModelInFilter(displayName, modelFilter) {
+		if !s.models.Allowed(m) {
 			continue // Skip models not in filter
 		}
+		if !s.isEligibleFreeModel(m, req) {
+			continue // Skip models that cannot see the images, call the tools or honor response_format
+		}
 
-		skip, err := failureStore.ShouldSkip(m)
+		skip, err := s.store.ShouldSkip(m)
 		if err != nil {
 			slog.Error("db error", "error", err)
 			continue
@@ -782,29 +629,70 @@ func getFreeChat(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessa
 		if skip {
 			continue
 		}
-		resp, err = provider.Chat(msgs, m)
-		if err != nil {
+		resp, err = s.recordedChat(ctx, req, m)
+		if isCancelled(ctx, err) {
+			slog.Info("request cancelled by client", "model", m)
+			return resp, "", ctx.Err()
+		}
+		var outErr *outputError
+		if err != nil && !errors.As(err, &outErr) {
 			slog.Warn("model failed", "model", m, "error", err)
-			_ = failureStore.MarkFailure(m)
+			_ = s.store.MarkFailure(m, err)
+			if isAuthError(err) {
+				return resp, "", err // Every other model would reject the key too
+			}
 			continue
 		}
 		// Clear failure record on successful request
-		_ = failureStore.ClearFailure(m)
+		_ = s.store.ClearFailure(m)
+		if outErr != nil {
+			// The model is healthy, just not good at this schema; try the next one
+			slog.Warn("model returned non-conforming structured output", "model", m, "error", err)
+			continue
+		}
 		return resp, m, nil
 	}
-	return resp, "", fmt.Errorf("no free models available")
+	err := noFreeModelsError(needsVision)
+	for _, m := range s.lastResortModels(req, exclude, v) {
+		lastReq, capErr := s.lastResortRequest(req, m)
+		if capErr != nil {
+			err = fmt.Errorf("%w; %v", err, capErr)
+			break
+		}
+		var chatErr error
+		resp, chatErr = s.recordedChat(ctx, lastReq, m)
+		if isCancelled(ctx, chatErr) {
+			return resp, "", ctx.Err()
+		}
+		if chatErr == nil {
+			return resp, m, nil
+		}
+		slog.Warn("last resort model failed", "model", m, "error", chatErr)
+		if s.paid.IsPaid(m) {
+			_ = s.store.MarkFailure(m, chatErr)
+		}
+		err = fmt.Errorf("%w; %s failed: %v", err, m, chatErr)
+	}
+	return resp, "", err
 }
 
-func getFreeStream(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage) (*openai.ChatCompletionStream, string, error) {
-	for _, m := range freeModels {
+// getFreeStream opens a stream on the first available free model, skipping
+// the models in exclude, in the order of the virtual model v when it is set
+func (s *server) getFreeStream(ctx context.Context, req ChatRequest, exclude map[string]bool, v *virtualModel) (chatStream, string, error) {
+	needsVision := requestHasImages(req)
+	for _, m := range s.freeCandidates(v) {
+		if exclude[m] {
+			continue // Already failed during this request
+		}
 		// Apply model filter if it exists
-		parts := strings.Split(m, "/")
-		displayName := parts[len(parts)-1]
-		if !isModelInFilter(displayName, modelFilter) {
+		if !s.models.Allowed(m) {
 			continue // Skip models not in filter
 		}
+		if !s.isEligibleFreeModel(m, req) {
+			continue // Skip models that cannot see the images, call the tools or honor response_format
+		}
 
-		skip, err := failureStore.ShouldSkip(m)
+		skip, err := s.store.ShouldSkip(m)
 		if err != nil {
 			slog.Error("db error", "error", err)
 			continue
@@ -812,97 +700,293 @@ func getFreeStream(provider *OpenrouterProvider, msgs []openai.ChatCompletionMes
 		if skip {
 			continue
 		}
-		stream, err := provider.ChatStream(msgs, m)
+		stream, err := s.openStream(ctx, req, m)
+		if isCancelled(ctx, err) {
+			slog.Info("request cancelled by client", "model", m)
+			return nil, "", ctx.Err()
+		}
 		if err != nil {
 			slog.Warn("model failed", "model", m, "error", err)
-			_ = failureStore.MarkFailure(m)
+			_ = s.store.MarkFailure(m, err)
+			if isAuthError(err) {
+				return nil, "", err // Every other model would reject the key too
+			}
 			continue
 		}
 		// Clear failure record on successful request
-		_ = failureStore.ClearFailure(m)
+		_ = s.store.ClearFailure(m)
 		return stream, m, nil
 	}
-	return nil, "", fmt.Errorf("no free models available")
+	err := noFreeModelsError(needsVision)
+	for _, m := range s.lastResortModels(req, exclude, v) {
+		lastReq, capErr := s.lastResortRequest(req, m)
+		if capErr != nil {
+			err = fmt.Errorf("%w; %v", err, capErr)
+			break
+		}
+		stream, streamErr := s.openStream(ctx, lastReq, m)
+		if isCancelled(ctx, streamErr) {
+			return nil, "", ctx.Err()
+		}
+		if streamErr == nil {
+			return stream, m, nil
+		}
+		slog.Warn("last resort model failed", "model", m, "error", streamErr)
+		if s.paid.IsPaid(m) {
+			_ = s.store.MarkFailure(m, streamErr)
+		}
+		err = fmt.Errorf("%w; %s failed: %v", err, m, streamErr)
+	}
+	return nil, "", err
+}
+
+func noFreeModelsError(needsVision bool) error {
+	if needsVision {
+		return errors.New("no free vision models available")
+	}
+	return errors.New("no free models available")
 }
 
-// resolveDisplayNameToFullModel resolves a display name back to the full model name
-func resolveDisplayNameToFullModel(displayName string) string {
-	for _, fullModel := range freeModels {
-		parts := strings.Split(fullModel, "/")
-		modelDisplayName := parts[len(parts)-1]
-		if modelDisplayName == displayName {
-			// Apply model filter if it exists
-			if !isModelInFilter(displayName, modelFilter) {
-				continue // Skip models not in filter
+// lastResortModels lists what is tried once every free model has failed or
+// is benched: the fallback model, then in hybrid mode the paid models whose
+// catalog prices fit the limits. Models the virtual model v does not allow
+// are left out.
+func (s *server) lastResortModels(req ChatRequest, exclude map[string]bool, v *virtualModel) []string {
+	var candidates []string
+	if s.fallbackModel != "" {
+		candidates = append(candidates, s.fallbackModel)
+	}
+	if s.paid != nil {
+		catalog := s.models.Catalog()
+		for _, m := range s.paid.Models {
+			info, ok := catalog.Lookup(m)
+			if !ok || !s.paid.Fits(info) {
+				slog.Warn("skipping paid model that is not in the catalog or over the price limit", "model", m)
+				continue
+			}
+			if skip, err := s.store.ShouldSkip(m); err != nil || skip {
+				continue
 			}
-			return fullModel
+			candidates = append(candidates, m)
+		}
+	}
+
+	var models []string
+	for _, m := range candidates {
+		if !exclude[m] && s.isEligibleFreeModel(m, req) && v.Allows(s.models.Catalog().Model(m)) {
+			models = append(models, m)
 		}
 	}
-	return displayName // fallback to original name if not found
+	return models
+}
+
+// lastResortRequest prepares req for a last-resort model. Paid models are
+// refused once a spend cap is reached and get OpenRouter's max_price.
+func (s *server) lastResortRequest(req ChatRequest, model string) (ChatRequest, error) {
+	if !s.paid.IsPaid(model) {
+		slog.Warn("no free model available, using fallback model", "model", model)
+		return req, nil
+	}
+	if err := s.reserveSpend(req, model); err != nil {
+		slog.Warn("not falling back to paid models", "error", err)
+		return req, err
+	}
+	slog.Warn("no free model available, using paid model", "model", model)
+	return s.paid.WithMaxPrice(req), nil
+}
+
+// setModelTier tells clients in hybrid mode whether a paid model served them
+func (s *server) setModelTier(c *gin.Context, model string) {
+	if s.paid == nil {
+		return
+	}
+	tier := "free"
+	if s.paid.IsPaid(model) {
+		tier = "paid"
+	}
+	c.Header("X-Model-Tier", tier)
 }
 
-// getFreeChatForModel tries to use a specific model first, then falls back to any available free model
-func getFreeChatForModel(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string) (openai.ChatCompletionResponse, string, error) {
+// getFreeChatForModel tries to use a specific model first, then falls back to
+// any available free model. Models of the other providers do not fall back.
+func (s *server) getFreeChatForModel(ctx context.Context, req ChatRequest, requestedModel string) (openai.ChatCompletionResponse, string, error) {
 	var resp openai.ChatCompletionResponse
+	if chain := s.fallbackChain(req, requestedModel); chain != nil {
+		slog.Info("Routing client fallback chain", "models", chain)
+		return s.getChainChat(ctx, req, chain)
+	}
+	if v := s.virtualModel(requestedModel); v != nil {
+		slog.Info("Routing virtual model", "model", v.ID)
+		return s.getFreeChat(ctx, req, nil, v)
+	}
 
-	// First try the requested model if it's in our free models list
-	fullModelName := resolveDisplayNameToFullModel(requestedModel)
-	if fullModelName != requestedModel || contains(freeModels, fullModelName) {
-		skip, err := failureStore.ShouldSkip(fullModelName)
+	// First try the requested model if it's in our free models list. A model
+	// that failed here is not tried again by the fallback below: errors caused
+	// by the request do not bench it.
+	fullModelName := s.models.Resolve(requestedModel)
+	if s.providers.Owner(fullModelName) != "" {
+		// A model of another provider was picked deliberately: its errors go
+		// back to the client instead of being answered by an OpenRouter model
+		if !s.models.Routable(fullModelName) {
+			return resp, "", fmt.Errorf("model %s is not available", fullModelName)
+		}
+		resp, err := s.recordedChat(ctx, req, fullModelName)
+		return resp, fullModelName, err
+	}
+	exclude := map[string]bool{}
+	if s.models.Routable(fullModelName) && s.isEligibleFreeModel(fullModelName, req) {
+		skip, err := s.store.ShouldSkip(fullModelName)
 		if err == nil && !skip {
-			resp, err = provider.Chat(msgs, fullModelName)
-			if err == nil {
-				_ = failureStore.ClearFailure(fullModelName)
-				return resp, fullModelName, nil
+			resp, err = s.recordedChat(ctx, req, fullModelName)
+			if isCancelled(ctx, err) {
+				slog.Info("request cancelled by client", "model", fullModelName)
+				return resp, "", ctx.Err()
+			}
+			var outErr *outputError
+			if err == nil || errors.As(err, &outErr) {
+				_ = s.store.ClearFailure(fullModelName)
+				if err == nil {
+					return resp, fullModelName, nil
+				}
+				slog.Warn("requested model returned non-conforming structured output, trying fallback", "model", fullModelName, "error", err)
+				exclude[fullModelName] = true // it would likely fail the same schema again
+			} else {
+				slog.Warn("requested model failed, trying fallback", "model", fullModelName, "error", err)
+				_ = s.store.MarkFailure(fullModelName, err)
+				exclude[fullModelName] = true
+				if isAuthError(err) {
+					return resp, "", err
+				}
 			}
-			slog.Warn("requested model failed, trying fallback", "model", fullModelName, "error", err)
-			_ = failureStore.MarkFailure(fullModelName)
 		}
 	}
 
 	// Fallback to any available free model
-	return getFreeChat(provider, msgs)
+	return s.getFreeChat(ctx, req, exclude, nil)
 }
 
-// getFreeStreamForModel tries to use a specific model first, then falls back to any available free model
-func getFreeStreamForModel(provider *OpenrouterProvider, msgs []openai.ChatCompletionMessage, requestedModel string) (*openai.ChatCompletionStream, string, error) {
-	// First try the requested model if it's in our free models list
-	fullModelName := resolveDisplayNameToFullModel(requestedModel)
-	if fullModelName != requestedModel || contains(freeModels, fullModelName) {
-		skip, err := failureStore.ShouldSkip(fullModelName)
+// getFreeStreamForModel tries to use a specific model first, then falls back
+// to any available free model. Models of the other providers do not fall back.
+func (s *server) getFreeStreamForModel(ctx context.Context, req ChatRequest, requestedModel string) (chatStream, string, error) {
+	if chain := s.fallbackChain(req, requestedModel); chain != nil {
+		slog.Info("Routing client fallback chain", "models", chain)
+		return s.getChainStream(ctx, req, chain, nil)
+	}
+	if v := s.virtualModel(requestedModel); v != nil {
+		slog.Info("Routing virtual model", "model", v.ID)
+		return s.getFreeStream(ctx, req, nil, v)
+	}
+	// First try the requested model if it's in our free models list, keeping
+	// the fallback below from trying it again if it fails
+	fullModelName := s.models.Resolve(requestedModel)
+	if s.providers.Owner(fullModelName) != "" {
+		// Models of other providers never fall back to OpenRouter
+		if !s.models.Routable(fullModelName) {
+			return nil, "", fmt.Errorf("model %s is not available", fullModelName)
+		}
+		stream, err := s.openStream(ctx, req, fullModelName)
+		return stream, fullModelName, err
+	}
+	exclude := map[string]bool{}
+	if s.models.Routable(fullModelName) && s.isEligibleFreeModel(fullModelName, req) {
+		skip, err := s.store.ShouldSkip(fullModelName)
 		if err == nil && !skip {
-			stream, err := provider.ChatStream(msgs, fullModelName)
+			stream, err := s.openStream(ctx, req, fullModelName)
+			if isCancelled(ctx, err) {
+				slog.Info("request cancelled by client", "model", fullModelName)
+				return nil, "", ctx.Err()
+			}
 			if err == nil {
-				_ = failureStore.ClearFailure(fullModelName)
+				_ = s.store.ClearFailure(fullModelName)
 				return stream, fullModelName, nil
 			}
 			slog.Warn("requested model failed, trying fallback", "model", fullModelName, "error", err)
-			_ = failureStore.MarkFailure(fullModelName)
+			_ = s.store.MarkFailure(fullModelName, err)
+			exclude[fullModelName] = true
+			if isAuthError(err) {
+				return nil, "", err
+			}
 		}
 	}
 
 	// Fallback to any available free model
-	return getFreeStream(provider, msgs)
+	return s.getFreeStream(ctx, req, exclude, nil)
 }
 
-// contains checks if a slice contains a string
-func contains(slice []string, item string) bool {
-	for _, s := range slice {
-		if s == item {
-			return true
-		}
+// chatForModel runs req against requestedModel, going through the free model
+// fallback chain in free mode
+func (s *server) chatForModel(ctx context.Context, req ChatRequest, requestedModel string) (openai.ChatCompletionResponse, string, error) {
+	if s.freeMode {
+		return s.getFreeChatForModel(ctx, req, requestedModel)
 	}
-	return false
+	return s.directChat(ctx, req, requestedModel)
+}
+
+// chatStreamForModel is the streaming counterpart of chatForModel
+func (s *server) chatStreamForModel(ctx context.Context, req ChatRequest, requestedModel string) (chatStream, string, error) {
+	if s.freeMode {
+		return s.getFreeStreamForModel(ctx, req, requestedModel)
+	}
+	return s.directStream(ctx, req, requestedModel)
 }
 
-// isModelInFilter checks if a model name matches any filter pattern (supports partial matches)
-func isModelInFilter(modelName string, filter map[string]struct{}) bool {
-	if len(filter) == 0 {
-		return true // No filter means all models are allowed
+// directChat runs req outside free mode: on the requested model, or on the
+// models of a client fallback chain in order
+func (s *server) directChat(ctx context.Context, req ChatRequest, requestedModel string) (openai.ChatCompletionResponse, string, error) {
+	if chain := s.fallbackChain(req, requestedModel); chain != nil {
+		slog.Info("Routing client fallback chain", "models", chain)
+		return s.getChainChat(ctx, req, chain)
+	}
+	fullModelName := s.models.Resolve(requestedModel)
+	resp, err := s.recordedChat(ctx, req, fullModelName)
+	return resp, fullModelName, err
+}
+
+// directStream is the streaming counterpart of directChat
+func (s *server) directStream(ctx context.Context, req ChatRequest, requestedModel string) (chatStream, string, error) {
+	if chain := s.fallbackChain(req, requestedModel); chain != nil {
+		slog.Info("Routing client fallback chain", "models", chain)
+		return s.getChainStream(ctx, req, chain, nil)
+	}
+	fullModelName := s.models.Resolve(requestedModel)
+	stream, err := s.openStream(ctx, req, fullModelName)
+	return stream, fullModelName, err
+}
+
+// isEligibleFreeModel reports whether a model's metadata allows it to serve
+// req, considering attached images, tools and the requested response_format.
+// Provider models that report no capabilities, as OpenAI-compatible backends
+// do, are left for the backend to accept or refuse.
+func (s *server) isEligibleFreeModel(model string, req ChatRequest) bool {
+	info := s.models.Catalog().Model(model)
+	if info.Provider != "" && len(info.SupportedParameters) == 0 {
+		return true
+	}
+	if requestHasImages(req) && !s.isVisionModel(model) {
+		return false
 	}
-	
-	for filterPattern := range filter {
-		if strings.Contains(modelName, filterPattern) {
+	params := info.SupportedParameters
+	if len(req.Tools) > 0 && !supportsToolUse(params) {
+		return false
+	}
+	return supportsStructuredOutput(params, req)
+}
+
+// isVisionModel reports whether a model accepts image input
+func (s *server) isVisionModel(model string) bool {
+	return supportsImages(s.models.Catalog().Model(model).Architecture.InputModalities)
+}
+
+// isCancelled reports whether a failed upstream call was caused by the client
+// going away rather than by the model, so it must not count as a model failure
+func isCancelled(ctx context.Context, err error) bool {
+	return err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled))
+}
+
+// contains checks if a slice contains a string
+func contains(slice []string, item string) bool {
+	for _, s := range slice {
+		if s == item {
 			return true
 		}
 	}
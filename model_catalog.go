@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// catalogVersion is bumped whenever the cache layout changes; caches with
+	// another version are refetched
+	catalogVersion = 1
+	// catalogMaxAge is how long a cache file is trusted at startup
+	catalogMaxAge = 24 * time.Hour
+	// legacyFreeModelsPath is the line-based cache written by older versions
+	legacyFreeModelsPath = "free-models"
+)
+
+// catalogModel is OpenRouter's record for one model
+type catalogModel struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Created       int64  `json:"created"`
+	Description   string `json:"description"`
+	ContextLength int    `json:"context_length"`
+	Architecture  struct {
+		Modality         string   `json:"modality"`
+		InputModalities  []string `json:"input_modalities"`
+		OutputModalities []string `json:"output_modalities"`
+		Tokenizer        string   `json:"tokenizer"`
+		InstructType     string   `json:"instruct_type"`
+	} `json:"architecture"`
+	Pricing struct {
+		Prompt            string `json:"prompt"`
+		Completion        string `json:"completion"`
+		Request           string `json:"request,omitempty"`
+		Image             string `json:"image,omitempty"`
+		InternalReasoning string `json:"internal_reasoning,omitempty"`
+	} `json:"pricing"`
+	TopProvider struct {
+		ContextLength       int  `json:"context_length"`
+		MaxCompletionTokens int  `json:"max_completion_tokens"`
+		IsModerated         bool `json:"is_moderated"`
+	} `json:"top_provider"`
+	SupportedParameters []string `json:"supported_parameters"`
+	// Provider is the registered provider serving the model, empty for
+	// OpenRouter
+	Provider string `json:"provider,omitempty"`
+}
+
+// EffectiveContextLength prefers the context length of the provider that
+// actually serves the model
+func (m catalogModel) EffectiveContextLength() int {
+	if m.TopProvider.ContextLength > 0 {
+		return m.TopProvider.ContextLength
+	}
+	return m.ContextLength
+}
+
+// IsFree reports whether both prompt and completion tokens cost nothing
+func (m catalogModel) IsFree() bool {
+	return isZeroPrice(m.Pricing.Prompt) && isZeroPrice(m.Pricing.Completion)
+}
+
+func isZeroPrice(price string) bool {
+	f, err := strconv.ParseFloat(price, 64)
+	return err == nil && f == 0
+}
+
+// modelCatalog is the cached OpenRouter model list, as stored on disk
+type modelCatalog struct {
+	Version   int            `json:"version"`
+	FetchedAt time.Time      `json:"fetched_at"`
+	Models    []catalogModel `json:"models"`
+
+	byID map[string]*catalogModel
+}
+
+func newModelCatalog(models []catalogModel, fetchedAt time.Time) *modelCatalog {
+	c := &modelCatalog{Version: catalogVersion, FetchedAt: fetchedAt, Models: models}
+	c.index()
+	return c
+}
+
+func (c *modelCatalog) index() {
+	c.byID = make(map[string]*catalogModel, len(c.Models))
+	for i := range c.Models {
+		c.byID[c.Models[i].ID] = &c.Models[i]
+	}
+}
+
+// Lookup returns the record for a full OpenRouter model ID
+func (c *modelCatalog) Lookup(id string) (catalogModel, bool) {
+	m, ok := c.byID[id]
+	if !ok {
+		return catalogModel{}, false
+	}
+	return *m, true
+}
+
+// Model returns the record for id, or a bare record carrying only the ID
+// when the catalog does not know it
+func (c *modelCatalog) Model(id string) catalogModel {
+	if m, ok := c.Lookup(id); ok {
+		return m
+	}
+	return catalogModel{ID: id}
+}
+
+func fetchModelCatalog(provider Provider) (*modelCatalog, error) {
+	models, err := provider.Models(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return newModelCatalog(models, time.Now()), nil
+}
+
+// loadModelCatalog returns the model catalog, using the cache at path while it
+// is fresh. When OpenRouter cannot be reached a stale cache is used instead,
+// or failing that the free model IDs from a legacy free-models file.
+func loadModelCatalog(provider Provider, path string) (*modelCatalog, error) {
+	cached, cacheErr := readModelCatalog(path)
+	if cacheErr == nil && time.Since(cached.FetchedAt) < catalogMaxAge {
+		return cached, nil
+	}
+
+	catalog, err := fetchModelCatalog(provider)
+	if err == nil {
+		if err := writeModelCatalog(path, catalog); err != nil {
+			slog.Warn("failed to write model catalog cache", "path", path, "error", err)
+		} else if removeErr := os.Remove(legacyFreeModelsPath); removeErr == nil {
+			slog.Info("replaced legacy free-models cache", "path", path)
+		}
+		return catalog, nil
+	}
+
+	if cacheErr == nil {
+		slog.Warn("using stale model catalog", "fetchedAt", cached.FetchedAt, "error", err)
+		return cached, nil
+	}
+	if legacy, legacyErr := readLegacyFreeModels(legacyFreeModelsPath); legacyErr == nil {
+		slog.Warn("using legacy free-models cache", "models", len(legacy.Models), "error", err)
+		return legacy, nil
+	}
+	return nil, err
+}
+
+func readModelCatalog(path string) (*modelCatalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c modelCatalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.Version != catalogVersion {
+		return nil, fmt.Errorf("model catalog cache has version %d, want %d", c.Version, catalogVersion)
+	}
+	c.index()
+	return &c, nil
+}
+
+// writeModelCatalog replaces the cache file atomically so a crash never
+// leaves a truncated catalog behind
+func writeModelCatalog(path string, c *modelCatalog) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readLegacyFreeModels converts the old free-models file, one model per line
+// with optional tab-separated context length, input modalities and supported
+// parameters, into a catalog. Every model in it was free when it was written.
+// FetchedAt is left zero so the catalog is refetched as soon as possible.
+func readLegacyFreeModels(path string) (*modelCatalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var models []catalogModel
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		m := catalogModel{ID: strings.TrimSpace(fields[0])}
+		m.Pricing.Prompt, m.Pricing.Completion = "0", "0"
+		switch len(fields) {
+		case 4:
+			m.ContextLength, _ = strconv.Atoi(fields[1])
+			m.Architecture.InputModalities = splitList(fields[2])
+			m.SupportedParameters = splitList(fields[3])
+		case 3:
+			m.Architecture.InputModalities = splitList(fields[1])
+			m.SupportedParameters = splitList(fields[2])
+		}
+		models = append(models, m)
+	}
+	return newModelCatalog(models, time.Time{}), nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultFilterPath is where the models-filter is read from when
+	// MODELS_FILTER_PATH is not set
+	defaultFilterPath = "/models-filter/filter"
+	// filterPollInterval is how often the filter file is checked for changes.
+	// Polling rather than inotify also picks up edits on bind mounts, where
+	// file events from the host are often not delivered.
+	filterPollInterval = 5 * time.Second
+)
+
+// filterRule is one line of the models-filter
+type filterRule struct {
+	source  string
+	exclude bool
+	match   func(id string) bool
+}
+
+// modelFilter decides which models are offered. A model is allowed when it
+// matches an include rule, or when there are none, and matches no exclude
+// rule. A nil filter allows every model.
+type modelFilter struct {
+	rules    []filterRule
+	includes int
+}
+
+// parseModelFilter reads one rule per line, matched against the full
+// vendor/model ID:
+//
+//	gemini            substring of the ID
+//	google/*          glob, also tried against the name after the vendor
+//	re:^qwen/.*:free$ regular expression
+//	!pattern          exclude models matching any of the above
+//	# comment
+func parseModelFilter(r io.Reader) (*modelFilter, error) {
+	filter := &modelFilter{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := filterRule{source: line}
+		pattern := line
+		if strings.HasPrefix(pattern, "!") {
+			rule.exclude = true
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		match, err := filterMatcher(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rule.match = match
+		if !rule.exclude {
+			filter.includes++
+		}
+		filter.rules = append(filter.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func filterMatcher(pattern string) (func(id string) bool, error) {
+	switch {
+	case pattern == "":
+		return nil, fmt.Errorf("empty pattern")
+	case strings.HasPrefix(pattern, "re:"):
+		re, err := regexp.Compile(pattern[len("re:"):])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+		return func(id string) bool {
+			full, _ := path.Match(pattern, id)
+			short, _ := path.Match(pattern, displayName(id))
+			return full || short
+		}, nil
+	default:
+		return func(id string) bool { return strings.Contains(id, pattern) }, nil
+	}
+}
+
+func loadModelFilter(path string) (*modelFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseModelFilter(file)
+}
+
+// Allows reports whether the filter admits a full model ID
+func (f *modelFilter) Allows(id string) bool {
+	if f == nil {
+		return true
+	}
+	included := f.includes == 0
+	for _, rule := range f.rules {
+		if !rule.match(id) {
+			continue
+		}
+		if rule.exclude {
+			return false
+		}
+		included = true
+	}
+	return included
+}
+
+// filterWatcher keeps the catalog service's filter in sync with the filter
+// file, which may appear, change or disappear while the proxy runs
+type filterWatcher struct {
+	path    string
+	models  *catalogService
+	present bool
+	modTime time.Time
+	size    int64
+}
+
+func newFilterWatcher(path string, models *catalogService) *filterWatcher {
+	return &filterWatcher{path: path, models: models}
+}
+
+// Reload applies the filter file if it changed since the last call. An
+// invalid file leaves the current filter in place.
+func (w *filterWatcher) Reload() error {
+	info, err := os.Stat(w.path)
+	if os.IsNotExist(err) {
+		if w.present {
+			slog.Info("models-filter removed, allowing all models", "path", w.path)
+			w.models.SetFilter(nil)
+		}
+		w.present = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if w.present && info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return nil
+	}
+	// Remember the version even if it fails to parse, so a broken file is
+	// reported once rather than on every poll
+	w.present, w.modTime, w.size = true, info.ModTime(), info.Size()
+
+	filter, err := loadModelFilter(w.path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", w.path, err)
+	}
+	w.models.SetFilter(filter)
+	slog.Info("Loaded models filter", "path", w.path, "rules", len(filter.rules))
+	for _, rule := range filter.rules {
+		slog.Info(" - " + rule.source)
+	}
+	return nil
+}
+
+// Run polls the filter file for changes; it never returns
+func (w *filterWatcher) Run() {
+	ticker := time.NewTicker(filterPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := w.Reload(); err != nil {
+			slog.Error("failed to reload models filter, keeping current one", "error", err)
+		}
+	}
+}
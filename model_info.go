@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// modelFormat is reported as the model format, since the weights are never
+// local files here
+const modelFormat = "openrouter"
+
+// parameterSizePattern matches sizes in model IDs such as 70b, 1.5b, 8x7b or 500m
+var parameterSizePattern = regexp.MustCompile(`(?i)(?:^|[-_:/.])(?:(\d+)x)?(\d+(?:\.\d+)?)([bm])(?:$|[-_:/.])`)
+
+// modelSlug returns the part of an OpenRouter ID after the vendor, without
+// a variant suffix such as ":free"
+func modelSlug(id string) string {
+	slug := id[strings.LastIndex(id, "/")+1:]
+	if i := strings.IndexByte(slug, ':'); i >= 0 {
+		slug = slug[:i]
+	}
+	return slug
+}
+
+// modelFamily derives a family such as "llama", "gemma" or "qwen" from the
+// leading letters of the model name
+func modelFamily(m catalogModel) string {
+	slug := strings.ToLower(modelSlug(m.ID))
+	end := strings.IndexFunc(slug, func(r rune) bool { return !unicode.IsLetter(r) })
+	if end < 0 {
+		end = len(slug)
+	}
+	if end > 0 {
+		return slug[:end]
+	}
+	if tokenizer := strings.ToLower(m.Architecture.Tokenizer); tokenizer != "" && tokenizer != "other" {
+		return tokenizer
+	}
+	return "unknown"
+}
+
+// modelFamilies lists the family, the tokenizer family and the vendor
+func modelFamilies(m catalogModel) []string {
+	families := []string{modelFamily(m)}
+	add := func(f string) {
+		f = strings.ToLower(f)
+		if f != "" && f != "other" && !contains(families, f) {
+			families = append(families, f)
+		}
+	}
+	add(m.Architecture.Tokenizer)
+	if i := strings.IndexByte(m.ID, '/'); i > 0 {
+		add(m.ID[:i])
+	}
+	return families
+}
+
+// parameterSize parses the parameter size from a model ID, returning it in
+// Ollama's notation ("70B", "8x7B") and as a count; both are empty when the
+// ID does not state it
+func parameterSize(id string) (string, int64) {
+	match := parameterSizePattern.FindStringSubmatch(modelSlug(id))
+	if match == nil {
+		return "", 0
+	}
+	n, err := strconv.ParseFloat(match[2], 64)
+	if err != nil {
+		return "", 0
+	}
+	unit := strings.ToUpper(match[3])
+	scale := 1e9
+	if unit == "M" {
+		scale = 1e6
+	}
+	size := match[2] + unit
+	if match[1] != "" {
+		experts, _ := strconv.Atoi(match[1])
+		size = match[1] + "x" + size
+		n *= float64(experts)
+	}
+	return size, int64(math.Round(n * scale))
+}
+
+// modelCapabilities derives Ollama's capabilities from the supported
+// parameters and input modalities
+func modelCapabilities(m catalogModel) []string {
+	capabilities := []string{"completion"}
+	if supportsToolUse(m.SupportedParameters) {
+		capabilities = append(capabilities, "tools")
+	}
+	if supportsImages(m.Architecture.InputModalities) {
+		capabilities = append(capabilities, "vision")
+	}
+	if supportsReasoning(m.SupportedParameters) {
+		capabilities = append(capabilities, "thinking")
+	}
+	return capabilities
+}
+
+// modelDigest is a stable per-model digest, so clients that de-duplicate by
+// digest keep every model apart
+func modelDigest(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// modelCreated is when OpenRouter added the model, or when the catalog was
+// fetched for records that lack it
+func modelCreated(m catalogModel, fetched time.Time) time.Time {
+	if m.Created > 0 {
+		return time.Unix(m.Created, 0).UTC()
+	}
+	if !fetched.IsZero() {
+		return fetched.UTC()
+	}
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// modelVendor is the OpenRouter ID prefix, such as "meta-llama"
+func modelVendor(id string) string {
+	if i := strings.IndexByte(id, '/'); i > 0 {
+		return id[:i]
+	}
+	return "openrouter"
+}
+
+// ollamaModel renders a catalog model fetched at fetched as an /api/tags
+// entry named name
+func ollamaModel(m catalogModel, name string, fetched time.Time) Model {
+	return Model{
+		Name:       name,
+		Model:      name,
+		ModifiedAt: modelCreated(m, fetched).Format(time.RFC3339),
+		Digest:     modelDigest(m.ID),
+		Details:    modelDetails(m),
+	}
+}
+
+// openAIModel renders a catalog model as a /v1/models entry with the given
+// id, adding OpenRouter's context length and pricing
+func openAIModel(m catalogModel, id string, fetched time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             id,
+		"object":         "model",
+		"created":        modelCreated(m, fetched).Unix(),
+		"owned_by":       modelVendor(m.ID),
+		"name":           m.Name,
+		"context_length": m.EffectiveContextLength(),
+		"pricing": map[string]string{
+			"prompt":     m.Pricing.Prompt,
+			"completion": m.Pricing.Completion,
+		},
+	}
+}
+
+func modelDetails(m catalogModel) ModelDetails {
+	size, _ := parameterSize(m.ID)
+	return ModelDetails{
+		Format:        modelFormat,
+		Family:        modelFamily(m),
+		Families:      modelFamilies(m),
+		ParameterSize: size,
+	}
+}
+
+// modelTemplate synthesizes a chat template. The upstream applies the
+// model's real template; this one documents the roles and tool support for
+// clients that display or inspect it.
+func modelTemplate(m catalogModel) string {
+	var b strings.Builder
+	if supportsToolUse(m.SupportedParameters) {
+		b.WriteString("{{- if .Tools }}<|tools|>\n{{ range .Tools }}{{ . }}\n{{ end }}{{ end }}\n")
+	}
+	b.WriteString("{{- if .System }}<|system|>\n{{ .System }}\n{{ end }}\n")
+	b.WriteString("{{- range .Messages }}<|{{ .Role }}|>\n{{ .Content }}\n")
+	if supportsToolUse(m.SupportedParameters) {
+		b.WriteString("{{- range .ToolCalls }}{{ .Function.Name }}({{ .Function.Arguments }})\n{{ end }}")
+	}
+	b.WriteString("{{ end }}<|assistant|>\n")
+	return b.String()
+}
+
+// modelParameters renders the default parameters in Modelfile syntax
+func modelParameters(m catalogModel) string {
+	var lines []string
+	if ctx := m.EffectiveContextLength(); ctx > 0 {
+		lines = append(lines, fmt.Sprintf("num_ctx %d", ctx))
+	}
+	if m.TopProvider.MaxCompletionTokens > 0 {
+		lines = append(lines, fmt.Sprintf("num_predict %d", m.TopProvider.MaxCompletionTokens))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func modelfile(m catalogModel, template, parameters string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Modelfile synthesized by the OpenRouter proxy\n# %s\n\nFROM openrouter/%s\n", m.Name, m.ID)
+	fmt.Fprintf(&b, "TEMPLATE \"\"\"%s\"\"\"\n", template)
+	for _, line := range strings.Split(parameters, "\n") {
+		if line != "" {
+			fmt.Fprintf(&b, "PARAMETER %s\n", line)
+		}
+	}
+	return b.String()
+}
+
+// showResponse builds Ollama's /api/show response for a catalog model
+func showResponse(m catalogModel, fetched time.Time) map[string]interface{} {
+	details := modelDetails(m)
+	_, count := parameterSize(m.ID)
+
+	info := map[string]interface{}{
+		"general.architecture":             details.Family,
+		"general.basename":                 modelSlug(m.ID),
+		"general.name":                     m.Name,
+		"general.description":              m.Description,
+		details.Family + ".context_length": m.EffectiveContextLength(),
+		"openrouter.id":                    m.ID,
+		"openrouter.tokenizer":             m.Architecture.Tokenizer,
+		"openrouter.modality":              m.Architecture.Modality,
+		"openrouter.pricing.prompt":        m.Pricing.Prompt,
+		"openrouter.pricing.completion":    m.Pricing.Completion,
+	}
+	if count > 0 {
+		info["general.parameter_count"] = count
+	}
+	if m.Architecture.InstructType != "" {
+		info["openrouter.instruct_type"] = m.Architecture.InstructType
+	}
+	if m.TopProvider.MaxCompletionTokens > 0 {
+		info["openrouter.max_completion_tokens"] = m.TopProvider.MaxCompletionTokens
+	}
+
+	template := modelTemplate(m)
+	parameters := modelParameters(m)
+	response := map[string]interface{}{
+		"modelfile":    modelfile(m, template, parameters),
+		"parameters":   parameters,
+		"template":     template,
+		"details":      details,
+		"model_info":   info,
+		"capabilities": modelCapabilities(m),
+	}
+	response["modified_at"] = modelCreated(m, fetched).Format(time.RFC3339)
+	return response
+}
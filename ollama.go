@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// OllamaMessage is a chat message in Ollama's dialect, which carries tool
+// calls with object arguments and answers them with role "tool" plus tool_name
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type OllamaToolCall struct {
+	Function OllamaToolCallFunction `json:"function"`
+}
+
+type OllamaToolCallFunction struct {
+	Index     int             `json:"index,omitempty"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toOpenAIMessages converts Ollama messages to OpenAI ones. Ollama tool calls
+// have no IDs, so IDs are synthesized and each tool result is linked to the
+// oldest unanswered call with the same function name.
+func toOpenAIMessages(msgs []OllamaMessage) []openai.ChatCompletionMessage {
+	out := make([]openai.ChatCompletionMessage, 0, len(msgs))
+	var pending []openai.ToolCall
+	for i, m := range msgs {
+		msg := openai.ChatCompletionMessage{Role: m.Role, Content: m.Content}
+		if len(m.Images) > 0 {
+			msg.Content = ""
+			msg.MultiContent = append([]openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: m.Content}}, imageContentParts(m.Images)...)
+		}
+		for j, call := range m.ToolCalls {
+			toolCall := openai.ToolCall{
+				ID:   fmt.Sprintf("call_%d_%d", i, j),
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      call.Function.Name,
+					Arguments: toolArgumentsString(call.Function.Arguments),
+				},
+			}
+			msg.ToolCalls = append(msg.ToolCalls, toolCall)
+			pending = append(pending, toolCall)
+		}
+		if m.Role == openai.ChatMessageRoleTool {
+			for k, call := range pending {
+				if m.ToolName == "" || call.Function.Name == m.ToolName {
+					msg.ToolCallID = call.ID
+					pending = append(pending[:k], pending[k+1:]...)
+					break
+				}
+			}
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// toOllamaToolCalls converts OpenAI tool calls to Ollama's format, decoding
+// the JSON-encoded argument string back into an object
+func toOllamaToolCalls(calls []openai.ToolCall) []OllamaToolCall {
+	var out []OllamaToolCall
+	for i, call := range calls {
+		args := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(args) {
+			// Keep malformed arguments visible to the client rather than dropping them
+			args, _ = json.Marshal(call.Function.Arguments)
+		}
+		out = append(out, OllamaToolCall{Function: OllamaToolCallFunction{
+			Index:     i,
+			Name:      call.Function.Name,
+			Arguments: args,
+		}})
+	}
+	return out
+}
+
+// toolArgumentsString encodes Ollama's object arguments as the JSON string
+// OpenAI expects, passing through arguments that are already a string
+func toolArgumentsString(args json.RawMessage) string {
+	if len(args) == 0 {
+		return "{}"
+	}
+	var s string
+	if json.Unmarshal(args, &s) == nil {
+		return s
+	}
+	return string(args)
+}
+
+// maxToolCalls bounds the tool call index trusted from upstream deltas
+const maxToolCalls = 128
+
+// accumulateToolCalls merges streamed tool call deltas into complete calls,
+// keyed by the delta index. Deltas with an index out of range are dropped.
+func accumulateToolCalls(calls []openai.ToolCall, deltas []openai.ToolCall) []openai.ToolCall {
+	for _, delta := range deltas {
+		index := len(calls)
+		if delta.Index != nil {
+			index = *delta.Index
+		}
+		if index < 0 || index >= maxToolCalls {
+			continue
+		}
+		for len(calls) <= index {
+			calls = append(calls, openai.ToolCall{Type: openai.ToolTypeFunction})
+		}
+		call := &calls[index]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Function.Name != "" {
+			call.Function.Name += delta.Function.Name
+		}
+		call.Function.Arguments += delta.Function.Arguments
+	}
+	return calls
+}
+
+// applyOllamaOptions translates an Ollama "options" object onto req and returns
+// the names of options that have no OpenRouter equivalent
+func applyOllamaOptions(req *ChatRequest, options map[string]json.RawMessage) ([]string, error) {
+	var unsupported []string
+	for name, value := range options {
+		var err error
+		switch name {
+		case "temperature":
+			err = setSampling(req, "temperature", value, &req.Temperature)
+		case "top_p":
+			err = setSampling(req, "top_p", value, &req.TopP)
+		case "presence_penalty":
+			err = setSampling(req, "presence_penalty", value, &req.PresencePenalty)
+		case "frequency_penalty":
+			err = setSampling(req, "frequency_penalty", value, &req.FrequencyPenalty)
+		case "top_k", "min_p":
+			// OpenRouter accepts these natively
+			var v float64
+			if err = json.Unmarshal(value, &v); err == nil {
+				req.setExtra(name, v)
+			}
+		case "num_predict":
+			// -1 (infinite) and -2 (fill context) mean "no limit" upstream
+			var v int
+			if err = json.Unmarshal(value, &v); err == nil && v > 0 {
+				req.MaxTokens = v
+			}
+		case "stop":
+			err = json.Unmarshal(value, &req.Stop)
+		case "seed":
+			var v int
+			if err = json.Unmarshal(value, &v); err == nil {
+				req.Seed = &v
+			}
+		default:
+			unsupported = append(unsupported, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %q: %w", name, err)
+		}
+	}
+
+	// repeat_penalty is multiplicative with 1.0 as neutral; approximate it with
+	// the additive frequency_penalty unless the client set that explicitly
+	if value, ok := options["repeat_penalty"]; ok {
+		if _, explicit := options["frequency_penalty"]; !explicit {
+			var v float64
+			if err := json.Unmarshal(value, &v); err != nil {
+				return nil, fmt.Errorf("invalid option %q: %w", "repeat_penalty", err)
+			}
+			penalty := float32(min(max(v-1, -2), 2))
+			req.FrequencyPenalty = penalty
+			if penalty == 0 {
+				req.setExtra("frequency_penalty", 0)
+			}
+		}
+		unsupported = removeString(unsupported, "repeat_penalty")
+	}
+
+	sort.Strings(unsupported)
+	return unsupported, nil
+}
+
+// setSampling decodes a float sampling option into field, recording an
+// explicit zero in Extra so it survives go-openai's omitempty
+func setSampling(req *ChatRequest, name string, value json.RawMessage, field *float32) error {
+	var v float32
+	if err := json.Unmarshal(value, &v); err != nil {
+		return err
+	}
+	*field = v
+	if v == 0 {
+		req.setExtra(name, 0)
+	}
+	return nil
+}
+
+// removeString returns slice without any occurrence of item
+func removeString(slice []string, item string) []string {
+	out := slice[:0]
+	for _, s := range slice {
+		if s != item {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// ollamaResponseFormat maps Ollama's "format" field, either "json" or a JSON
+// schema object, to an OpenAI response_format
+func ollamaResponseFormat(format json.RawMessage) (*openai.ChatCompletionResponseFormat, error) {
+	format = bytes.TrimSpace(format)
+	if len(format) == 0 || string(format) == "null" || string(format) == `""` {
+		return nil, nil
+	}
+	if format[0] == '{' {
+		return &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "response",
+				Schema: format,
+				Strict: true,
+			},
+		}, nil
+	}
+	var s string
+	if err := json.Unmarshal(format, &s); err != nil || s != "json" {
+		return nil, fmt.Errorf("invalid format %s: expected \"json\" or a JSON schema", format)
+	}
+	return &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}, nil
+}
+
+// imageContentParts converts Ollama's base64 images into OpenAI image_url
+// content parts carrying data URIs
+func imageContentParts(images []string) []openai.ChatMessagePart {
+	var parts []openai.ChatMessagePart
+	for _, image := range images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: imageDataURI(image)},
+		})
+	}
+	return parts
+}
+
+// imageDataURI wraps raw base64 image data in a data URI, sniffing the MIME
+// type from the decoded header bytes
+func imageDataURI(image string) string {
+	if strings.HasPrefix(image, "data:") || strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://") {
+		return image
+	}
+	mimeType := "image/jpeg"
+	header := image[:min(len(image), 64)]
+	if decoded, err := base64.StdEncoding.DecodeString(header[:len(header)/4*4]); err == nil {
+		if sniffed := http.DetectContentType(decoded); strings.HasPrefix(sniffed, "image/") {
+			mimeType = sniffed
+		}
+	}
+	return "data:" + mimeType + ";base64," + image
+}
+
+// ollamaTimings measures the phases Ollama reports in its final message:
+// opening the upstream request (including free-model fallback) as load
+// duration, waiting for the first token as prompt evaluation and the rest as
+// generation
+type ollamaTimings struct {
+	start      time.Time
+	opened     time.Time
+	firstToken time.Time
+}
+
+func newOllamaTimings() *ollamaTimings {
+	return &ollamaTimings{start: time.Now()}
+}
+
+// Opened records that the upstream request has been accepted
+func (t *ollamaTimings) Opened() {
+	t.opened = time.Now()
+}
+
+// Token records the arrival of generated output; only the first call counts
+func (t *ollamaTimings) Token() {
+	if t.firstToken.IsZero() {
+		t.firstToken = time.Now()
+	}
+}
+
+// Stats returns Ollama's final-message statistics in nanoseconds together
+// with token counts from the upstream usage report
+func (t *ollamaTimings) Stats(usage *openai.Usage) map[string]interface{} {
+	end := time.Now()
+	opened, firstToken := t.opened, t.firstToken
+	if opened.IsZero() {
+		opened = t.start
+	}
+	if firstToken.IsZero() {
+		// Non-streamed responses arrive all at once
+		firstToken = opened
+	}
+
+	stats := map[string]interface{}{
+		"total_duration":       end.Sub(t.start).Nanoseconds(),
+		"load_duration":        opened.Sub(t.start).Nanoseconds(),
+		"prompt_eval_duration": firstToken.Sub(opened).Nanoseconds(),
+		"eval_duration":        end.Sub(firstToken).Nanoseconds(),
+		"prompt_eval_count":    0,
+		"eval_count":           0,
+	}
+	if usage != nil {
+		stats["prompt_eval_count"] = usage.PromptTokens
+		stats["eval_count"] = usage.CompletionTokens
+	}
+	return stats
+}
+
+// ollamaDoneReason maps an OpenAI finish reason to Ollama's done_reason
+func ollamaDoneReason(finishReason string) string {
+	switch finishReason {
+	case "", "tool_calls", "function_call":
+		return "stop"
+	}
+	return finishReason
+}
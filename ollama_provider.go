@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// OllamaProvider talks to an Ollama server through its native API, so
+// requests keep Ollama's own options and model metadata comes from
+// /api/show
+type OllamaProvider struct {
+	http    *http.Client
+	baseURL string
+}
+
+func NewOllamaProvider(baseURL string, headers http.Header) *OllamaProvider {
+	var transport http.RoundTripper = http.DefaultTransport
+	if len(headers) > 0 {
+		transport = headerTransport{base: transport, header: headers}
+	}
+	return &OllamaProvider{
+		http:    &http.Client{Transport: transport},
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []openai.Tool   `json:"tools,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"`
+	Options  map[string]any  `json:"options,omitempty"`
+	Stream   bool            `json:"stream"`
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         OllamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (o *OllamaProvider) Chat(ctx context.Context, req ChatRequest, model string) (openai.ChatCompletionResponse, error) {
+	body, err := o.post(ctx, "/api/chat", ollamaRequest(req, model, false))
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer body.Close()
+
+	var resp ollamaChatResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	if resp.Error != "" {
+		return openai.ChatCompletionResponse{}, errors.New(resp.Error)
+	}
+	toolCalls := fromOllamaToolCalls(resp.Message.ToolCalls)
+	return openai.ChatCompletionResponse{
+		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:      openai.ChatMessageRoleAssistant,
+				Content:   resp.Message.Content,
+				ToolCalls: toolCalls,
+			},
+			FinishReason: ollamaFinishReason(resp.DoneReason, len(toolCalls) > 0),
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+			TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+		},
+	}, nil
+}
+
+func (o *OllamaProvider) ChatStream(ctx context.Context, req ChatRequest, model string) (chatStream, error) {
+	body, err := o.post(ctx, "/api/chat", ollamaRequest(req, model, true))
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	return &ollamaStream{
+		body:    body,
+		scanner: scanner,
+		id:      fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
+		model:   model,
+	}, nil
+}
+
+// Models lists the local models from /api/tags, reading context length and
+// capabilities from /api/show. The models carry no pricing, so they never
+// join the free model chain on their own.
+func (o *OllamaProvider) Models(ctx context.Context) ([]catalogModel, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", o.baseURL+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	var tags struct {
+		Models []struct {
+			Name       string    `json:"name"`
+			ModifiedAt time.Time `json:"modified_at"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+
+	models := make([]catalogModel, 0, len(tags.Models))
+	for _, t := range tags.Models {
+		m := catalogModel{ID: t.Name, Name: t.Name, Created: t.ModifiedAt.Unix()}
+		m.Architecture.InputModalities = []string{"text"}
+		if err := o.describe(ctx, &m); err != nil {
+			slog.Warn("failed to read Ollama model details", "model", t.Name, "error", err)
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// describe fills in the context length and capabilities /api/show reports
+func (o *OllamaProvider) describe(ctx context.Context, m *catalogModel) error {
+	body, err := o.post(ctx, "/api/show", map[string]string{"model": m.ID})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	var show struct {
+		Capabilities []string       `json:"capabilities"`
+		ModelInfo    map[string]any `json:"model_info"`
+		Details      struct {
+			Family string `json:"family"`
+		} `json:"details"`
+	}
+	if err := json.NewDecoder(body).Decode(&show); err != nil {
+		return err
+	}
+	for key, value := range show.ModelInfo {
+		if n, ok := value.(float64); ok && strings.HasSuffix(key, ".context_length") {
+			m.ContextLength = int(n)
+		}
+	}
+	m.Architecture.Tokenizer = show.Details.Family
+	// Ollama enforces format itself, so every model supports structured output
+	m.SupportedParameters = []string{"temperature", "top_p", "top_k", "min_p", "stop", "seed", "max_tokens", "response_format", "structured_outputs"}
+	for _, capability := range show.Capabilities {
+		switch capability {
+		case "tools":
+			m.SupportedParameters = append(m.SupportedParameters, "tools")
+		case "vision":
+			m.Architecture.InputModalities = append(m.Architecture.InputModalities, "image")
+		case "thinking":
+			m.SupportedParameters = append(m.SupportedParameters, "reasoning")
+		}
+	}
+	return nil
+}
+
+// post sends a JSON request and returns the body of a successful response.
+// Error responses are returned as *upstreamError so they are classified like
+// OpenAI-compatible ones.
+func (o *OllamaProvider) post(ctx context.Context, path string, payload any) (io.ReadCloser, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) != nil || body.Error == "" {
+		body.Error = resp.Status
+	}
+	return nil, &upstreamError{
+		err:    &openai.APIError{HTTPStatusCode: resp.StatusCode, HTTPStatus: resp.Status, Message: body.Error},
+		header: resp.Header,
+	}
+}
+
+// ollamaRequest translates an OpenAI chat request to Ollama's /api/chat
+func ollamaRequest(req ChatRequest, model string, stream bool) ollamaChatRequest {
+	out := ollamaChatRequest{
+		Model:    model,
+		Messages: toOllamaMessages(req.Messages),
+		Tools:    req.Tools,
+		Stream:   stream,
+		Options:  make(map[string]any),
+	}
+	// Explicit zeros survive go-openai's omitempty only in Extra
+	setOption := func(name string, value float32) {
+		if _, zero := req.Extra[name]; value != 0 || zero {
+			out.Options[name] = value
+		}
+	}
+	setOption("temperature", req.Temperature)
+	setOption("top_p", req.TopP)
+	setOption("presence_penalty", req.PresencePenalty)
+	setOption("frequency_penalty", req.FrequencyPenalty)
+	for _, name := range []string{"top_k", "min_p"} {
+		if v, ok := req.Extra[name]; ok {
+			out.Options[name] = v
+		}
+	}
+	if v, ok := req.Extra["repetition_penalty"]; ok {
+		out.Options["repeat_penalty"] = v
+	}
+	if n := max(req.MaxTokens, req.MaxCompletionTokens); n > 0 {
+		out.Options["num_predict"] = n
+	}
+	if len(req.Stop) > 0 {
+		out.Options["stop"] = req.Stop
+	}
+	if req.Seed != nil {
+		out.Options["seed"] = *req.Seed
+	}
+
+	if f := req.ResponseFormat; f != nil {
+		switch {
+		case f.Type == openai.ChatCompletionResponseFormatTypeJSONObject:
+			out.Format = json.RawMessage(`"json"`)
+		case f.Type == openai.ChatCompletionResponseFormatTypeJSONSchema && f.JSONSchema != nil && f.JSONSchema.Schema != nil:
+			if schema, err := json.Marshal(f.JSONSchema.Schema); err == nil {
+				out.Format = schema
+			}
+		}
+	}
+	return out
+}
+
+// toOllamaMessages converts OpenAI messages to Ollama's, turning image parts
+// back into base64 images and naming each tool result after its call
+func toOllamaMessages(msgs []openai.ChatCompletionMessage) []OllamaMessage {
+	toolNames := make(map[string]string)
+	out := make([]OllamaMessage, 0, len(msgs))
+	for _, m := range msgs {
+		msg := OllamaMessage{Role: m.Role, Content: m.Content, ToolCalls: toOllamaToolCalls(m.ToolCalls)}
+		for _, part := range m.MultiContent {
+			switch part.Type {
+			case openai.ChatMessagePartTypeText:
+				msg.Content += part.Text
+			case openai.ChatMessagePartTypeImageURL:
+				// Ollama only takes inline images
+				if _, data, ok := strings.Cut(part.ImageURL.URL, ";base64,"); ok {
+					msg.Images = append(msg.Images, data)
+				}
+			}
+		}
+		for _, call := range m.ToolCalls {
+			toolNames[call.ID] = call.Function.Name
+		}
+		if m.Role == openai.ChatMessageRoleTool {
+			msg.ToolName = toolNames[m.ToolCallID]
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// fromOllamaToolCalls converts Ollama tool calls to OpenAI ones, synthesizing
+// the IDs Ollama does not assign
+func fromOllamaToolCalls(calls []OllamaToolCall) []openai.ToolCall {
+	var out []openai.ToolCall
+	for i, call := range calls {
+		out = append(out, openai.ToolCall{
+			ID:   fmt.Sprintf("call_%d", i),
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: toolArgumentsString(call.Function.Arguments),
+			},
+		})
+	}
+	return out
+}
+
+// ollamaFinishReason maps Ollama's done_reason to an OpenAI finish reason
+func ollamaFinishReason(doneReason string, toolCalls bool) openai.FinishReason {
+	switch {
+	case toolCalls:
+		return openai.FinishReasonToolCalls
+	case doneReason == "length":
+		return openai.FinishReasonLength
+	}
+	return openai.FinishReasonStop
+}
+
+// ollamaStream translates Ollama's NDJSON stream into OpenAI chunk JSON
+type ollamaStream struct {
+	body      io.ReadCloser
+	scanner   *bufio.Scanner
+	id        string
+	model     string
+	toolCalls int
+	done      bool
+}
+
+func (s *ollamaStream) RecvRaw() ([]byte, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk ollamaChatResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return nil, err
+		}
+		if chunk.Error != "" {
+			return nil, errors.New(chunk.Error)
+		}
+		return json.Marshal(s.translate(chunk))
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("Ollama stream ended before done")
+}
+
+// translate builds the OpenAI chunk for an Ollama chunk. Chunks are built as
+// maps because they are passed through to OpenAI clients as they are, and
+// go-openai's types would add empty Azure-specific fields.
+func (s *ollamaStream) translate(chunk ollamaChatResponse) map[string]any {
+	delta := map[string]any{"role": openai.ChatMessageRoleAssistant, "content": chunk.Message.Content}
+	var toolCalls []openai.ToolCall
+	for _, call := range fromOllamaToolCalls(chunk.Message.ToolCalls) {
+		index := s.toolCalls
+		call.ID = fmt.Sprintf("call_%d", index)
+		call.Index = &index
+		toolCalls = append(toolCalls, call)
+		s.toolCalls++
+	}
+	if len(toolCalls) > 0 {
+		delta["tool_calls"] = toolCalls
+	}
+	choice := map[string]any{"index": 0, "delta": delta, "finish_reason": nil}
+	response := map[string]any{
+		"id":      s.id,
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   s.model,
+		"choices": []map[string]any{choice},
+	}
+	if chunk.Done {
+		s.done = true
+		choice["finish_reason"] = ollamaFinishReason(chunk.DoneReason, s.toolCalls > 0)
+		response["usage"] = map[string]int{
+			"prompt_tokens":     chunk.PromptEvalCount,
+			"completion_tokens": chunk.EvalCount,
+			"total_tokens":      chunk.PromptEvalCount + chunk.EvalCount,
+		}
+	}
+	return response
+}
+
+func (s *ollamaStream) Close() error { return s.body.Close() }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// streamChunkRewriter passes upstream chat completion chunks through verbatim,
+// so tool call, role, refusal and reasoning deltas survive, while giving every
+// chunk of one response the same id, created timestamp and model name
+type streamChunkRewriter struct {
+	id      string
+	created int64
+	model   string
+}
+
+func newStreamChunkRewriter(model string) *streamChunkRewriter {
+	now := time.Now()
+	return &streamChunkRewriter{
+		id:      fmt.Sprintf("chatcmpl-%d", now.UnixNano()),
+		created: now.Unix(),
+		model:   model,
+	}
+}
+
+func (r *streamChunkRewriter) Rewrite(raw []byte) ([]byte, error) {
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &chunk); err != nil {
+		return nil, err
+	}
+	chunk["id"], _ = json.Marshal(r.id)
+	chunk["object"], _ = json.Marshal("chat.completion.chunk")
+	chunk["created"], _ = json.Marshal(r.created)
+	chunk["model"], _ = json.Marshal(r.model)
+	return json.Marshal(chunk)
+}
@@ -2,168 +2,197 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
 
-type OpenrouterProvider struct {
-	client     *openai.Client
-	modelNames []string // Shared storage for model names
+// Provider is an upstream backend serving chat completions. Model IDs passed
+// to and returned by a provider are in its own namespace, without the
+// provider prefix the proxy adds.
+type Provider interface {
+	// Chat sends req upstream as a non-streaming completion against model
+	Chat(ctx context.Context, req ChatRequest, model string) (openai.ChatCompletionResponse, error)
+	// ChatStream is the streaming counterpart of Chat
+	ChatStream(ctx context.Context, req ChatRequest, model string) (chatStream, error)
+	// Models lists the models the provider serves
+	Models(ctx context.Context) ([]catalogModel, error)
 }
 
-func NewOpenrouterProvider(apiKey string) *OpenrouterProvider {
+// chatStream is an open completion stream yielding OpenAI chunk JSON, as
+// *openai.ChatCompletionStream does
+type chatStream interface {
+	RecvRaw() ([]byte, error)
+	Close() error
+}
+
+// OpenAIProvider talks to any OpenAI-compatible API, such as a llama.cpp or
+// vLLM server, Groq, Together or a company gateway
+type OpenAIProvider struct {
+	client  *openai.Client
+	http    *http.Client
+	baseURL string
+	apiKey  string
+}
+
+// NewOpenAIProvider creates a provider for the API at baseURL, sending
+// headers with every request
+func NewOpenAIProvider(baseURL, apiKey string, headers http.Header) *OpenAIProvider {
+	baseURL = strings.TrimRight(baseURL, "/")
+	var transport http.RoundTripper = http.DefaultTransport
+	if len(headers) > 0 {
+		transport = headerTransport{base: transport, header: headers}
+	}
+	httpClient := &http.Client{Transport: extraFieldsTransport{base: responseHeaderTransport{base: transport}}}
+
 	config := openai.DefaultConfig(apiKey)
-	config.BaseURL = "https://openrouter.ai/api/v1/" // Custom endpoint if needed
-	return &OpenrouterProvider{
-		client:     openai.NewClientWithConfig(config),
-		modelNames: []string{},
+	config.BaseURL = baseURL
+	config.HTTPClient = httpClient
+	return &OpenAIProvider{
+		client:  openai.NewClientWithConfig(config),
+		http:    httpClient,
+		baseURL: baseURL,
+		apiKey:  apiKey,
 	}
 }
 
-func (o *OpenrouterProvider) Chat(messages []openai.ChatCompletionMessage, modelName string) (openai.ChatCompletionResponse, error) {
-	// Create a chat completion request
-	req := openai.ChatCompletionRequest{
-		Model:    modelName,
-		Messages: messages,
-		Stream:   false,
-	}
+// Chat forwards every sampling parameter the client supplied. Cancelling ctx
+// aborts the upstream request.
+func (o *OpenAIProvider) Chat(ctx context.Context, req ChatRequest, model string) (openai.ChatCompletionResponse, error) {
+	req.Model = model
+	req.Stream = false
+	req.StreamOptions = nil
 
 	// Call the OpenAI API to get a complete response
-	resp, err := o.client.CreateChatCompletion(context.Background(), req)
+	ctx, header := withResponseHeader(withExtraFields(ctx, req.Extra))
+	resp, err := o.client.CreateChatCompletion(ctx, req.ChatCompletionRequest)
 	if err != nil {
-		return openai.ChatCompletionResponse{}, err
+		return openai.ChatCompletionResponse{}, &upstreamError{err: err, header: *header}
 	}
 
 	// Return the complete response
 	return resp, nil
 }
 
-func (o *OpenrouterProvider) ChatStream(messages []openai.ChatCompletionMessage, modelName string) (*openai.ChatCompletionStream, error) {
-	// Create a chat completion request
-	req := openai.ChatCompletionRequest{
-		Model:    modelName,
-		Messages: messages,
-		Stream:   true,
-	}
+func (o *OpenAIProvider) ChatStream(ctx context.Context, req ChatRequest, model string) (chatStream, error) {
+	req.Model = model
+	req.Stream = true
 
 	// Call the OpenAI API to get a streaming response
-	stream, err := o.client.CreateChatCompletionStream(context.Background(), req)
+	ctx, header := withResponseHeader(withExtraFields(ctx, req.Extra))
+	stream, err := o.client.CreateChatCompletionStream(ctx, req.ChatCompletionRequest)
 	if err != nil {
-		return nil, err
+		return nil, &upstreamError{err: err, header: *header}
 	}
 
 	// Return the stream for further processing
 	return stream, nil
 }
 
-type ModelDetails struct {
-	ParentModel       string   `json:"parent_model"`
-	Format            string   `json:"format"`
-	Family            string   `json:"family"`
-	Families          []string `json:"families"`
-	ParameterSize     string   `json:"parameter_size"`
-	QuantizationLevel string   `json:"quantization_level"`
-}
-
-type Model struct {
-	Name       string       `json:"name"`
-	Model      string       `json:"model,omitempty"`
-	ModifiedAt string       `json:"modified_at,omitempty"`
-	Size       int64        `json:"size,omitempty"`
-	Digest     string       `json:"digest,omitempty"`
-	Details    ModelDetails `json:"details,omitempty"`
+// Models reads GET /models. Besides the ID, OpenAI-compatible backends
+// report little that is common to all of them; the context length is taken
+// from the fields llama.cpp, vLLM and Together use.
+func (o *OpenAIProvider) Models(ctx context.Context) ([]catalogModel, error) {
+	var result struct {
+		Data []struct {
+			ID            string `json:"id"`
+			Created       int64  `json:"created"`
+			ContextLength int    `json:"context_length"`
+			MaxModelLen   int    `json:"max_model_len"`
+		} `json:"data"`
+	}
+	if err := o.getModels(ctx, &result); err != nil {
+		return nil, err
+	}
+	models := make([]catalogModel, 0, len(result.Data))
+	for _, d := range result.Data {
+		m := catalogModel{ID: d.ID, Name: d.ID, Created: d.Created, ContextLength: d.ContextLength}
+		if m.ContextLength == 0 {
+			m.ContextLength = d.MaxModelLen
+		}
+		models = append(models, m)
+	}
+	return models, nil
 }
 
-func (o *OpenrouterProvider) GetModels() ([]Model, error) {
-	currentTime := time.Now().Format(time.RFC3339)
-
-	// Fetch models from the OpenAI API
-	modelsResponse, err := o.client.ListModels(context.Background())
+// getModels decodes the response of GET /models into v
+func (o *OpenAIProvider) getModels(ctx context.Context, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", o.baseURL+"/models", nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// Clear shared model storage
-	o.modelNames = []string{}
-
-	var models []Model
-	for _, apiModel := range modelsResponse.Models {
-		// Split model name
-		parts := strings.Split(apiModel.ID, "/")
-		name := parts[len(parts)-1]
-
-		// Store name in shared storage
-		o.modelNames = append(o.modelNames, apiModel.ID)
-
-		// Create model struct
-		model := Model{
-			Name:       name,
-			Model:      name,
-			ModifiedAt: currentTime,
-			Size:       0, // Stubbed size
-			Digest:     name,
-			Details: ModelDetails{
-				ParentModel:       "",
-				Format:            "gguf",
-				Family:            "claude",
-				Families:          []string{"claude"},
-				ParameterSize:     "175B",
-				QuantizationLevel: "Q4_K_M",
-			},
-		}
-		models = append(models, model)
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
 	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
-	return models, nil
+// OpenrouterProvider is the default upstream. It is OpenAI-compatible;
+// OpenRouter-specific request fields such as provider routing pass through
+// ChatRequest.Extra.
+type OpenrouterProvider struct {
+	*OpenAIProvider
 }
 
-func (o *OpenrouterProvider) GetModelDetails(modelName string) (map[string]interface{}, error) {
-	// Stub response; replace with actual model details if available
-	currentTime := time.Now().Format(time.RFC3339)
-	return map[string]interface{}{
-		"license":    "STUB License",
-		"system":     "STUB SYSTEM",
-		"modifiedAt": currentTime,
-		"details": map[string]interface{}{
-			"format":             "gguf",
-			"parameter_size":     "200B",
-			"quantization_level": "Q4_K_M",
-		},
-		"model_info": map[string]interface{}{
-			"architecture":    "STUB",
-			"context_length":  200000,
-			"parameter_count": 200_000_000_000,
-		},
-	}, nil
+func NewOpenrouterProvider(apiKey string) *OpenrouterProvider {
+	return &OpenrouterProvider{NewOpenAIProvider("https://openrouter.ai/api/v1", apiKey, nil)}
 }
 
-func (o *OpenrouterProvider) GetFullModelName(alias string) (string, error) {
-	// If modelNames is empty or not populated yet, try to get models first
-	if len(o.modelNames) == 0 {
-		_, err := o.GetModels()
-		if err != nil {
-			return "", fmt.Errorf("failed to get models: %w", err)
-		}
+// Models returns OpenRouter's full records, with pricing, modalities and
+// supported parameters
+func (o *OpenrouterProvider) Models(ctx context.Context) ([]catalogModel, error) {
+	var result struct {
+		Data []catalogModel `json:"data"`
 	}
-
-	// First try exact match
-	for _, fullName := range o.modelNames {
-		if fullName == alias {
-			return fullName, nil
-		}
+	if err := o.getModels(ctx, &result); err != nil {
+		return nil, err
 	}
+	return result.Data, nil
+}
 
-	// Then try suffix match
-	for _, fullName := range o.modelNames {
-		if strings.HasSuffix(fullName, alias) {
-			return fullName, nil
-		}
+// headerTransport adds fixed headers, such as gateway credentials, to every
+// request
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.header {
+		req.Header[k] = v
 	}
+	return t.base.RoundTrip(req)
+}
+
+type ModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
 
-	// If no match found, just use the alias as is
-	// This allows direct use of model names that might not be in the list
-	return alias, nil
+type Model struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model,omitempty"`
+	ModifiedAt string       `json:"modified_at,omitempty"`
+	Size       int64        `json:"size"` // no local weights, so always 0
+	Digest     string       `json:"digest,omitempty"`
+	Details    ModelDetails `json:"details,omitempty"`
 }
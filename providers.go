@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// providerNamePattern keeps provider names usable as a model ID prefix and
+// in environment variable names
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// providerSet routes model IDs to upstream providers. OpenRouter is the
+// default and keeps its IDs as they are; the models of every other provider
+// are namespaced as "<name>/<model>".
+type providerSet struct {
+	def   Provider
+	named map[string]Provider
+	names []string // registration order
+}
+
+func newProviderSet(def Provider) *providerSet {
+	return &providerSet{def: def, named: make(map[string]Provider)}
+}
+
+// Register adds a provider whose models are namespaced by name
+func (p *providerSet) Register(name string, provider Provider) error {
+	if !providerNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid provider name %q", name)
+	}
+	if _, ok := p.named[name]; ok {
+		return fmt.Errorf("provider %q registered twice", name)
+	}
+	p.named[name] = provider
+	p.names = append(p.names, name)
+	return nil
+}
+
+// Route returns the provider serving a full model ID and the ID in that
+// provider's namespace
+func (p *providerSet) Route(id string) (Provider, string) {
+	if i := strings.IndexByte(id, '/'); i > 0 {
+		if provider, ok := p.named[id[:i]]; ok {
+			return provider, id[i+1:]
+		}
+	}
+	return p.def, id
+}
+
+// Owner returns the name of the registered provider serving a full model ID,
+// or "" for OpenRouter models
+func (p *providerSet) Owner(id string) string {
+	if name, _, ok := strings.Cut(id, "/"); ok {
+		if _, found := p.named[name]; found {
+			return name
+		}
+	}
+	return ""
+}
+
+// CheckVendors returns an error when a provider is named like the vendor
+// prefix of an OpenRouter model in catalog: Route would send that vendor's
+// models, such as openai/gpt-4o for a provider named "openai", to the
+// provider instead of OpenRouter
+func (p *providerSet) CheckVendors(catalog *modelCatalog) error {
+	for _, m := range catalog.Models {
+		if m.Provider != "" {
+			continue
+		}
+		if vendor, _, ok := strings.Cut(m.ID, "/"); ok {
+			if _, taken := p.named[vendor]; taken {
+				return fmt.Errorf("provider %q is named like the OpenRouter vendor of %s; choose another name", vendor, m.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// withProviderModels returns base plus the models of every registered
+// provider, namespaced by provider name. A provider that cannot be reached
+// keeps the models it had in prev, so a backend restarting during a refresh
+// does not drop out of the listings.
+func (p *providerSet) withProviderModels(base, prev *modelCatalog) *modelCatalog {
+	if len(p.names) == 0 {
+		return base
+	}
+	models := make([]catalogModel, 0, len(base.Models))
+	for _, m := range base.Models {
+		if m.Provider == "" {
+			models = append(models, m)
+		}
+	}
+	for _, name := range p.names {
+		list, err := p.named[name].Models(context.Background())
+		if err != nil {
+			slog.Warn("failed to list provider models", "provider", name, "error", err)
+			if prev != nil {
+				for _, m := range prev.Models {
+					if m.Provider == name {
+						models = append(models, m)
+					}
+				}
+			}
+			continue
+		}
+		for _, m := range list {
+			m.ID = name + "/" + m.ID
+			m.Provider = name
+			models = append(models, m)
+		}
+	}
+	return newModelCatalog(models, base.FetchedAt)
+}
+
+// loadProviders registers the providers listed in PROVIDERS, for example
+//
+//	PROVIDERS=local,groq
+//	PROVIDER_LOCAL_TYPE=ollama
+//	PROVIDER_LOCAL_BASE_URL=http://localhost:11435
+//	PROVIDER_GROQ_BASE_URL=https://api.groq.com/openai/v1
+//	PROVIDER_GROQ_API_KEY=...
+//	PROVIDER_GROQ_HEADERS=X-Team: search; X-Env: prod
+//
+// TYPE is "openai" (the default) for OpenAI-compatible APIs or "ollama" for
+// a native Ollama server.
+func loadProviders(set *providerSet) error {
+	for _, name := range strings.Split(os.Getenv("PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "PROVIDER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		baseURL := os.Getenv(prefix + "BASE_URL")
+		if baseURL == "" {
+			return fmt.Errorf("provider %q: %sBASE_URL is not set", name, prefix)
+		}
+		headers, err := parseHeaders(os.Getenv(prefix + "HEADERS"))
+		if err != nil {
+			return fmt.Errorf("provider %q: %w", name, err)
+		}
+		kind := os.Getenv(prefix + "TYPE")
+		if kind == "" {
+			kind = "openai"
+		}
+		var provider Provider
+		switch kind {
+		case "openai":
+			provider = NewOpenAIProvider(baseURL, os.Getenv(prefix+"API_KEY"), headers)
+		case "ollama":
+			provider = NewOllamaProvider(baseURL, headers)
+		default:
+			return fmt.Errorf("provider %q: unknown %sTYPE %q", name, prefix, kind)
+		}
+		if err := set.Register(name, provider); err != nil {
+			return err
+		}
+		slog.Info("Registered provider", "name", name, "type", kind, "baseURL", baseURL)
+	}
+	return nil
+}
+
+// parseHeaders reads "Name: value" pairs separated by semicolons
+func parseHeaders(s string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, pair := range strings.Split(s, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, want \"Name: value\"", strings.TrimSpace(pair))
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return headers, nil
+}
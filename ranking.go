@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// rankWindow is how far back observed calls count towards a model's score
+	rankWindow = 6 * time.Hour
+	// rankTTL is how long a computed ranking is reused before stats are re-read
+	rankTTL = 30 * time.Second
+	// exploreRate is the share of requests that first try a model picked at
+	// random, so benched or slow models that recovered get measured again
+	exploreRate = 0.1
+)
+
+// Score weights; they sum to 1
+const (
+	weightReliability = 0.5
+	weightContext     = 0.2
+	weightLatency     = 0.15
+	weightThroughput  = 0.15
+)
+
+// Priors used until a model has enough observations of its own. The success
+// prior counts as a few calls, so one early failure does not sink a model.
+const (
+	priorSuccessRate = 0.8
+	priorAttempts    = 3
+	// Latency and throughput at which their scores reach 0.5
+	latencyMidpointMs = 5000
+	throughputMid     = 40
+)
+
+// freeModelRanker orders the free models by observed reliability and speed,
+// caching the ranking and the stats it was computed from for rankTTL
+type freeModelRanker struct {
+	mu         sync.Mutex
+	order      []string
+	stats      map[string]ModelStats
+	source     []string
+	computedAt time.Time
+}
+
+// rankedFreeModels returns the free models in the order they should be tried
+// for the next request, and the stats they were ranked by, which callers must
+// not modify
+func (s *server) rankedFreeModels() ([]string, map[string]ModelStats) {
+	order, stats := s.ranker.ranked(s.models.FreeModels(), s.store)
+	if len(order) > 1 && rand.Float64() < exploreRate {
+		// Explore: move a random lower-ranked model to the front
+		i := 1 + rand.Intn(len(order)-1)
+		explored := append([]string{order[i]}, order[:i]...)
+		order = append(explored, order[i+1:]...)
+	}
+	return order, stats
+}
+
+func (r *freeModelRanker) ranked(set *freeModelSet, store *FailureStore) ([]string, map[string]ModelStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	models := set.IDs
+	if time.Since(r.computedAt) < rankTTL && sameModels(r.source, models) {
+		return append([]string(nil), r.order...), r.stats
+	}
+
+	stats, err := store.ModelStats(rankWindow)
+	if err != nil {
+		// Fall back to the catalog order rather than failing requests
+		slog.Error("failed to read model stats for ranking", "error", err)
+		return append([]string(nil), models...), nil
+	}
+	r.order = rankModels(models, set.Info, stats)
+	r.stats = stats
+	r.source = models
+	r.computedAt = time.Now()
+	return append([]string(nil), r.order...), r.stats
+}
+
+// rankModels sorts models by score, keeping the catalog order between equals
+func rankModels(models []string, info map[string]freeModel, stats map[string]ModelStats) []string {
+	maxContext := 1
+	for _, m := range models {
+		maxContext = max(maxContext, info[m].ContextLength)
+	}
+	scores := make(map[string]float64, len(models))
+	for _, m := range models {
+		scores[m] = scoreModel(info[m].ContextLength, maxContext, stats[m])
+	}
+	order := append([]string(nil), models...)
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+	return order
+}
+
+// scoreModel combines context length with the observed success rate, median
+// latency and throughput into a score between 0 and 1
+func scoreModel(contextLength, maxContext int, s ModelStats) float64 {
+	// Context matters on a log scale: 8k to 32k is a bigger step than 128k to 160k
+	contextScore := 0.0
+	if contextLength > 1 && maxContext > 1 {
+		contextScore = math.Log(float64(contextLength)) / math.Log(float64(maxContext))
+	}
+
+	reliability := (float64(s.Successes) + priorSuccessRate*priorAttempts) / (float64(s.Attempts) + priorAttempts)
+
+	// Unmeasured models get a neutral score for speed. Throughput is only
+	// measured on streamed calls, so models that have served nothing but
+	// stream:false requests stay neutral rather than looking instantaneous.
+	latencyScore, throughputScore := 0.5, 0.5
+	if s.Successes > 0 {
+		latencyScore = latencyMidpointMs / (latencyMidpointMs + float64(s.LatencyP50Ms))
+	}
+	if s.TokensPerSec > 0 {
+		throughputScore = s.TokensPerSec / (s.TokensPerSec + throughputMid)
+	}
+
+	return weightReliability*reliability + weightContext*contextScore +
+		weightLatency*latencyScore + weightThroughput*throughputScore
+}
+
+func sameModels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultRefreshInterval is how often the model catalog is re-fetched when
+// FREE_MODELS_REFRESH_INTERVAL is not set
+const defaultRefreshInterval = 6 * time.Hour
+
+var errNoModels = errors.New("OpenRouter returned no usable models")
+
+// catalogRefresher keeps the model catalog and the free model set derived
+// from it in sync with OpenRouter while the proxy runs
+type catalogRefresher struct {
+	providers *providerSet
+	cachePath string
+	interval  time.Duration
+	models    *catalogService
+	mu        sync.Mutex // serializes refreshes
+}
+
+// refreshResult reports what a refresh changed
+type refreshResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Total   int      `json:"total"`
+}
+
+func newCatalogRefresher(providers *providerSet, cachePath string, models *catalogService) *catalogRefresher {
+	interval := defaultRefreshInterval
+	if v := os.Getenv("FREE_MODELS_REFRESH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Warn("invalid FREE_MODELS_REFRESH_INTERVAL, using default", "value", v, "default", interval)
+		} else {
+			interval = d
+		}
+	}
+	return &catalogRefresher{providers: providers, cachePath: cachePath, interval: interval, models: models}
+}
+
+// Run refreshes the catalog every interval; it never returns
+func (r *catalogRefresher) Run() {
+	// A missing or stale catalog from a failed startup fetch is retried every
+	// minute rather than after a full interval
+	for c := r.models.Catalog(); len(c.Models) == 0 || time.Since(c.FetchedAt) > catalogMaxAge; c = r.models.Catalog() {
+		time.Sleep(time.Minute)
+		if _, err := r.Refresh(); err != nil {
+			slog.Error("model catalog refresh failed", "error", err)
+		}
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := r.Refresh(); err != nil {
+			slog.Error("background model catalog refresh failed, keeping current catalog", "error", err)
+		}
+	}
+}
+
+// Refresh fetches the model catalog now, rewrites the cache and swaps in the
+// new catalog, merged with the models of the other providers, together with
+// its free model set. On error the current ones stay in place. The result
+// lists the models clients can pick that were added or removed: the free
+// models in free mode, every model otherwise.
+func (r *catalogRefresher) Refresh() (refreshResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	catalog, err := fetchModelCatalog(r.providers.def)
+	if err != nil {
+		return refreshResult{}, err
+	}
+	if len(catalog.Models) == 0 || (r.models.freeMode && len(freeModelsFromCatalog(catalog)) == 0) {
+		// An empty list is more likely an upstream hiccup than every model
+		// being withdrawn at once
+		return refreshResult{}, errNoModels
+	}
+	if err := writeModelCatalog(r.cachePath, catalog); err != nil {
+		slog.Warn("failed to write model catalog cache", "error", err)
+	}
+	if err := r.providers.CheckVendors(catalog); err != nil {
+		// Routing keeps sending these IDs to the provider until it is renamed
+		slog.Error("provider name collides with a new OpenRouter vendor", "error", err)
+	}
+
+	catalog = r.providers.withProviderModels(catalog, r.models.Catalog())
+	prevCatalog, prevFree := r.models.Update(catalog)
+
+	prev, next := modelIDs(prevCatalog), modelIDs(catalog)
+	if r.models.freeMode {
+		prev, next = nil, r.models.FreeModels().IDs
+		if prevFree != nil {
+			prev = prevFree.IDs
+		}
+	}
+	result := refreshResult{Total: len(next)}
+	result.Added, result.Removed = diffModels(prev, next)
+	for _, id := range result.Added {
+		slog.Info("model added", "model", id)
+	}
+	for _, id := range result.Removed {
+		slog.Info("model removed", "model", id)
+	}
+	slog.Info("refreshed model catalog", "total", result.Total, "added", len(result.Added), "removed", len(result.Removed))
+	return result, nil
+}
+
+func modelIDs(c *modelCatalog) []string {
+	if c == nil {
+		return nil
+	}
+	ids := make([]string, len(c.Models))
+	for i, m := range c.Models {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// diffModels lists the IDs only in next and only in prev. Nothing counts as
+// added when there was no previous list.
+func diffModels(prev, next []string) (added, removed []string) {
+	if prev == nil {
+		return nil, nil
+	}
+	inPrev := make(map[string]bool, len(prev))
+	for _, id := range prev {
+		inPrev[id] = true
+	}
+	inNext := make(map[string]bool, len(next))
+	for _, id := range next {
+		inNext[id] = true
+		if !inPrev[id] {
+			added = append(added, id)
+		}
+	}
+	for _, id := range prev {
+		if !inNext[id] {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// server holds the state shared by the handlers. Its fields are set before
+// the HTTP server starts and never reassigned; state that changes while
+// requests are in flight (the catalog, the free model set, the filter and
+// the ranking) is swapped as immutable snapshots by catalogService and
+// freeModelRanker, so handlers never see it half-updated. The cost of paid
+// calls in flight is tracked under spendLedger's lock.
+type server struct {
+	providers *providerSet
+	store     *FailureStore
+	models    *catalogService
+	refresher *catalogRefresher
+	ranker    freeModelRanker
+	freeMode  bool
+	// fallbackModel is tried in free mode once every free model has failed
+	// or is benched, typically a model on a local provider
+	fallbackModel string
+	// paid is the paid model fallback in hybrid mode, nil otherwise
+	paid  *paidPolicy
+	spend spendLedger
+}
+
+func newServer(providers *providerSet, store *FailureStore, freeMode bool) *server {
+	return &server{
+		providers: providers,
+		store:     store,
+		models:    newCatalogService(store, freeMode),
+		freeMode:  freeMode,
+	}
+}
+
+// routes registers the Ollama and OpenAI-compatible endpoints
+func (s *server) routes() *gin.Engine {
+	r := gin.Default()
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "Ollama is running")
+	})
+	r.HEAD("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "")
+	})
+
+	r.GET("/api/tags", s.handleTags)
+	r.POST("/api/show", s.handleShow)
+	r.POST("/api/chat", s.handleChat)
+	r.POST("/api/generate", s.handleGenerate)
+	r.GET("/api/model-stats", s.handleModelStats)
+	r.POST("/api/refresh-models", s.handleRefreshModels)
+
+	r.POST("/v1/chat/completions", s.handleOpenAIChat)
+	r.GET("/v1/models", s.handleOpenAIModels)
+	return r
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeOpenRouter answers chat completions for any model, streamed or not,
+// the way OpenRouter does
+func fakeOpenRouter(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id":"gen-1","object":"chat.completion","model":%q,"choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`, req.Model)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			fmt.Sprintf(`{"id":"gen-1","object":"chat.completion.chunk","model":%q,"choices":[{"index":0,"delta":{"role":"assistant","content":"hel"}}]}`, req.Model),
+			fmt.Sprintf(`{"id":"gen-1","object":"chat.completion.chunk","model":%q,"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`, req.Model),
+			fmt.Sprintf(`{"id":"gen-1","object":"chat.completion.chunk","model":%q,"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`, req.Model),
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testCatalog returns free models whose metadata varies with generation, so
+// every update swaps in visibly different state
+func testCatalog(generation int) *modelCatalog {
+	var models []catalogModel
+	for i := 0; i < 6; i++ {
+		m := catalogModel{
+			ID:                  fmt.Sprintf("vendor%d/model-%d:free", i%3, i),
+			Name:                fmt.Sprintf("Model %d", i),
+			ContextLength:       8192 * (1 + (i+generation)%4),
+			SupportedParameters: []string{"tools", "temperature"},
+		}
+		m.Architecture.InputModalities = []string{"text"}
+		m.Pricing.Prompt, m.Pricing.Completion = "0", "0"
+		models = append(models, m)
+	}
+	return newModelCatalog(models, time.Now())
+}
+
+func newTestServer(t *testing.T) (*server, http.Handler) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store, err := NewFailureStore(t.TempDir() + "/failures.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	upstream := fakeOpenRouter(t)
+	srv := newServer(newProviderSet(NewOpenAIProvider(upstream.URL, "test-key", nil)), store, true)
+	srv.models.Update(testCatalog(0))
+	return srv, srv.routes()
+}
+
+// TestConcurrentRequestsDuringUpdates drives every model-facing endpoint
+// concurrently while the catalog and the models-filter are swapped. Run it
+// with -race: it checks that handlers only ever see consistent snapshots.
+func TestConcurrentRequestsDuringUpdates(t *testing.T) {
+	srv, handler := newTestServer(t)
+
+	// Filters that always leave some models routable
+	var filters []*modelFilter
+	for _, rules := range []string{"vendor0", "!vendor1", "re:model-[2-5]", "vendor*/*"} {
+		f, err := parseModelFilter(strings.NewReader(rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		filters = append(filters, f, nil)
+	}
+
+	stop := make(chan struct{})
+	var updaters sync.WaitGroup
+	updaters.Add(2)
+	go func() {
+		defer updaters.Done()
+		for gen := 1; ; gen++ {
+			select {
+			case <-stop:
+				return
+			default:
+				srv.models.Update(testCatalog(gen))
+			}
+		}
+	}()
+	go func() {
+		defer updaters.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				srv.models.SetFilter(filters[i%len(filters)])
+			}
+		}
+	}()
+
+	requests := []struct {
+		method, path, body string
+	}{
+		{"POST", "/api/chat", `{"model":"model-0:free","stream":false,"messages":[{"role":"user","content":"hi"}]}`},
+		{"POST", "/api/chat", `{"model":"model-3:free","messages":[{"role":"user","content":"hi"}]}`},
+		{"POST", "/v1/chat/completions", `{"model":"vendor1/model-1:free","messages":[{"role":"user","content":"hi"}]}`},
+		{"POST", "/v1/chat/completions", `{"model":"model-4:free","stream":true,"messages":[{"role":"user","content":"hi"}]}`},
+		{"GET", "/api/tags", ""},
+		{"GET", "/v1/models", ""},
+		{"POST", "/api/show", `{"model":"vendor2/model-2:free"}`},
+	}
+
+	const workers, iterations = 8, 20
+	var failures atomic.Int32
+	var clients sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		clients.Add(1)
+		go func(w int) {
+			defer clients.Done()
+			for i := 0; i < iterations; i++ {
+				r := requests[(w+i)%len(requests)]
+				var body io.Reader
+				if r.body != "" {
+					body = strings.NewReader(r.body)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(r.method, r.path, body))
+				if rec.Code != http.StatusOK {
+					failures.Add(1)
+					t.Errorf("%s %s: status %d: %s", r.method, r.path, rec.Code, rec.Body.String())
+					continue
+				}
+				if strings.Contains(r.path, "chat") && !strings.Contains(rec.Body.String(), "hel") {
+					failures.Add(1)
+					t.Errorf("%s %s: no completion in %s", r.method, r.path, rec.Body.String())
+				}
+			}
+		}(w)
+	}
+	clients.Wait()
+	close(stop)
+	updaters.Wait()
+
+	if n := failures.Load(); n > 0 {
+		t.Fatalf("%d of %d requests failed", n, workers*iterations)
+	}
+}
+
+// TestConcurrentRankingAndStats checks that ranking, which caches its order,
+// stays consistent while attempts are recorded and stats read concurrently
+func TestConcurrentRankingAndStats(t *testing.T) {
+	srv, handler := newTestServer(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				model := fmt.Sprintf("vendor%d/model-%d:free", w%3, w)
+				srv.recordAttempt(Attempt{Model: model, Outcome: OutcomeSuccess, Latency: time.Duration(i) * time.Millisecond, At: time.Now()})
+				if got, _ := srv.rankedFreeModels(); len(got) != 6 {
+					t.Errorf("ranked %d models, want 6", len(got))
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/model-stats?window=1h", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("model-stats: status %d", rec.Code)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// paidPolicy is hybrid mode's fallback onto paid models once every free
+// model has failed or is benched. Prices are in USD per million tokens and
+// limits in USD; zero means no limit.
+type paidPolicy struct {
+	Models        []string
+	MaxPrompt     float64
+	MaxCompletion float64
+	DailyLimit    float64
+	MonthlyLimit  float64
+}
+
+// loadPaidPolicy reads the hybrid mode settings:
+//
+//	PAID_MODELS=openai/gpt-4o-mini,anthropic/claude-3.5-haiku
+//	PAID_MAX_PRICE_PROMPT=1
+//	PAID_MAX_PRICE_COMPLETION=4
+//	PAID_DAILY_LIMIT=0.50
+//	PAID_MONTHLY_LIMIT=5
+func loadPaidPolicy() (*paidPolicy, error) {
+	p := &paidPolicy{}
+	for _, id := range strings.Split(os.Getenv("PAID_MODELS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			p.Models = append(p.Models, id)
+		}
+	}
+	if len(p.Models) == 0 {
+		return nil, fmt.Errorf("hybrid mode needs PAID_MODELS")
+	}
+	for name, field := range map[string]*float64{
+		"PAID_MAX_PRICE_PROMPT":     &p.MaxPrompt,
+		"PAID_MAX_PRICE_COMPLETION": &p.MaxCompletion,
+		"PAID_DAILY_LIMIT":          &p.DailyLimit,
+		"PAID_MONTHLY_LIMIT":        &p.MonthlyLimit,
+	} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*field = f
+	}
+	return p, nil
+}
+
+// IsPaid reports whether id is one of the paid fallback models
+func (p *paidPolicy) IsPaid(id string) bool {
+	return p != nil && contains(p.Models, id)
+}
+
+// Fits reports whether the catalog prices of m are within the price limits
+func (p *paidPolicy) Fits(m catalogModel) bool {
+	prompt, completion := pricePerMillion(m.Pricing.Prompt), pricePerMillion(m.Pricing.Completion)
+	return (p.MaxPrompt == 0 || prompt <= p.MaxPrompt) && (p.MaxCompletion == 0 || completion <= p.MaxCompletion)
+}
+
+// WithMaxPrice adds OpenRouter's provider.max_price to req, so no provider
+// charging more serves it, keeping other provider preferences of the client
+func (p *paidPolicy) WithMaxPrice(req ChatRequest) ChatRequest {
+	if p.MaxPrompt == 0 && p.MaxCompletion == 0 {
+		return req
+	}
+	maxPrice := map[string]float64{}
+	if p.MaxPrompt > 0 {
+		maxPrice["prompt"] = p.MaxPrompt
+	}
+	if p.MaxCompletion > 0 {
+		maxPrice["completion"] = p.MaxCompletion
+	}
+	provider := map[string]any{}
+	if existing, ok := req.Extra["provider"].(json.RawMessage); ok {
+		_ = json.Unmarshal(existing, &provider)
+	}
+	provider["max_price"] = maxPrice
+
+	extra := make(map[string]any, len(req.Extra)+1)
+	for k, v := range req.Extra {
+		extra[k] = v
+	}
+	extra["provider"] = provider
+	req.Extra = extra
+	return req
+}
+
+// pricePerMillion converts OpenRouter's per-token price string
+func pricePerMillion(price string) float64 {
+	f, _ := strconv.ParseFloat(price, 64)
+	return f * 1e6
+}
+
+// modelCost estimates the cost of a call in USD from the catalog prices
+func modelCost(m catalogModel, promptTokens, completionTokens int) float64 {
+	return (pricePerMillion(m.Pricing.Prompt)*float64(promptTokens) + pricePerMillion(m.Pricing.Completion)*float64(completionTokens)) / 1e6
+}
+
+func createSpend(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS spend (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		model TEXT NOT NULL,
+		cost REAL NOT NULL,
+		at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS spend_at ON spend(at)`)
+	return err
+}
+
+func (s *FailureStore) RecordSpend(model string, cost float64, at time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO spend(model, cost, at) VALUES(?, ?, ?)`, model, cost, at.Unix())
+	return err
+}
+
+// SpendSince sums the recorded spend from since on
+func (s *FailureStore) SpendSince(since time.Time) (float64, error) {
+	var total sql.NullFloat64
+	err := s.db.QueryRow(`SELECT SUM(cost) FROM spend WHERE at >= ?`, since.Unix()).Scan(&total)
+	return total.Float64, err
+}
+
+// estimatePromptTokens guesses the prompt size of req at four characters per
+// token, for paid calls whose usage the upstream never reported
+func estimatePromptTokens(req ChatRequest) int {
+	chars := 0
+	for _, m := range req.Messages {
+		chars += len(m.Content)
+		for _, part := range m.MultiContent {
+			chars += len(part.Text)
+		}
+	}
+	return estimateTokens(chars)
+}
+
+func estimateTokens(chars int) int {
+	return (chars + 3) / 4
+}
+
+const (
+	// reservationTTL bounds how long a reservation outlives a call that never
+	// booked its spend
+	reservationTTL = 10 * time.Minute
+	// reservedCompletionTokens is assumed for calls that set no max_tokens
+	reservedCompletionTokens = 1024
+)
+
+// spendLedger holds the estimated cost of the paid calls in flight until
+// their spend is booked, so concurrent fallbacks cannot all pass the cap
+type spendLedger struct {
+	mu           sync.Mutex
+	reservations []spendReservation
+}
+
+type spendReservation struct {
+	model string
+	cost  float64
+	until time.Time
+}
+
+// pending drops expired reservations and sums the rest
+func (l *spendLedger) pending(now time.Time) float64 {
+	kept := l.reservations[:0]
+	total := 0.0
+	for _, r := range l.reservations {
+		if now.Before(r.until) {
+			kept = append(kept, r)
+			total += r.cost
+		}
+	}
+	l.reservations = kept
+	return total
+}
+
+// release drops the oldest reservation for model
+func (l *spendLedger) release(model string) {
+	for i, r := range l.reservations {
+		if r.model == model {
+			l.reservations = append(l.reservations[:i], l.reservations[i+1:]...)
+			return
+		}
+	}
+}
+
+// reserveSpend checks the spend cap for a paid call of model and, when it
+// passes, reserves the call's estimated cost until recordSpend books it
+func (s *server) reserveSpend(req ChatRequest, model string) error {
+	s.spend.mu.Lock()
+	defer s.spend.mu.Unlock()
+	now := time.Now()
+	if err := s.checkSpendCap(s.spend.pending(now)); err != nil {
+		return err
+	}
+	completion := req.MaxTokens
+	if req.MaxCompletionTokens > 0 {
+		completion = req.MaxCompletionTokens
+	}
+	if completion == 0 {
+		completion = reservedCompletionTokens
+	}
+	cost := modelCost(s.models.Catalog().Model(model), estimatePromptTokens(req), completion)
+	s.spend.reservations = append(s.spend.reservations, spendReservation{model: model, cost: cost, until: now.Add(reservationTTL)})
+	return nil
+}
+
+// checkSpendCap returns an error once the paid models have used up the
+// daily or monthly limit, counting pending as spent. Days and months are
+// counted in UTC.
+func (s *server) checkSpendCap(pending float64) error {
+	now := time.Now().UTC()
+	caps := []struct {
+		name  string
+		limit float64
+		since time.Time
+	}{
+		{"daily", s.paid.DailyLimit, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)},
+		{"monthly", s.paid.MonthlyLimit, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range caps {
+		if c.limit == 0 {
+			continue
+		}
+		spent, err := s.store.SpendSince(c.since)
+		if err != nil {
+			return err
+		}
+		if spent+pending >= c.limit {
+			return fmt.Errorf("%s paid spend cap of $%.2f reached ($%.4f spent, $%.4f in flight)", c.name, c.limit, spent, pending)
+		}
+	}
+	return nil
+}
+
+// recordSpend books the cost of a paid model call in place of its reservation
+func (s *server) recordSpend(a Attempt) {
+	if !s.paid.IsPaid(a.Model) {
+		return
+	}
+	s.spend.mu.Lock()
+	defer s.spend.mu.Unlock()
+	s.spend.release(a.Model)
+	if a.PromptTokens+a.CompletionTokens == 0 {
+		return
+	}
+	cost := modelCost(s.models.Catalog().Model(a.Model), a.PromptTokens, a.CompletionTokens)
+	if err := s.store.RecordSpend(a.Model, cost, a.At); err != nil {
+		slog.Error("failed to record paid spend", "model", a.Model, "error", err)
+		return
+	}
+	slog.Info("paid model spend", "model", a.Model, "promptTokens", a.PromptTokens, "completionTokens", a.CompletionTokens, "cost", cost)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// parseResponseFormat decodes an OpenAI response_format. go-openai cannot
+// unmarshal the JSON schema itself, so it is kept as raw JSON.
+func parseResponseFormat(raw json.RawMessage) (*openai.ChatCompletionResponseFormat, error) {
+	var format struct {
+		Type       openai.ChatCompletionResponseFormatType `json:"type"`
+		JSONSchema *struct {
+			Name        string          `json:"name"`
+			Description string          `json:"description"`
+			Schema      json.RawMessage `json:"schema"`
+			Strict      bool            `json:"strict"`
+		} `json:"json_schema"`
+	}
+	if err := json.Unmarshal(raw, &format); err != nil {
+		return nil, err
+	}
+	result := &openai.ChatCompletionResponseFormat{Type: format.Type}
+	if format.JSONSchema != nil {
+		result.JSONSchema = &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:        format.JSONSchema.Name,
+			Description: format.JSONSchema.Description,
+			Strict:      format.JSONSchema.Strict,
+		}
+		if len(format.JSONSchema.Schema) > 0 {
+			result.JSONSchema.Schema = format.JSONSchema.Schema
+		}
+	}
+	return result, nil
+}
+
+// wantsStructuredOutput reports whether req asks for JSON output
+func wantsStructuredOutput(req ChatRequest) bool {
+	return req.ResponseFormat != nil && req.ResponseFormat.Type != "" && req.ResponseFormat.Type != openai.ChatCompletionResponseFormatTypeText
+}
+
+// supportsStructuredOutput reports whether a model's supported_parameters
+// allow the response_format requested by req
+func supportsStructuredOutput(supportedParams []string, req ChatRequest) bool {
+	if !wantsStructuredOutput(req) {
+		return true
+	}
+	return contains(supportedParams, "structured_outputs") || contains(supportedParams, "response_format")
+}
+
+// checkStructuredOutput validates a response against the requested
+// response_format, returning nil when no JSON output was requested. A code
+// fence around otherwise valid JSON is removed from resp.
+func checkStructuredOutput(req ChatRequest, resp *openai.ChatCompletionResponse) error {
+	if !wantsStructuredOutput(req) || len(resp.Choices) == 0 {
+		return nil
+	}
+	content := stripCodeFence(resp.Choices[0].Message.Content)
+	if err := validateStructuredOutput(req, content); err != nil {
+		return err
+	}
+	resp.Choices[0].Message.Content = content
+	return nil
+}
+
+func validateStructuredOutput(req ChatRequest, content string) error {
+	var value any
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+
+	format := req.ResponseFormat
+	if format.Type != openai.ChatCompletionResponseFormatTypeJSONSchema || format.JSONSchema == nil || format.JSONSchema.Schema == nil {
+		if _, ok := value.(map[string]any); !ok {
+			return fmt.Errorf("response is not a JSON object")
+		}
+		return nil
+	}
+
+	schemaJSON, err := format.JSONSchema.Schema.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	var schema any
+	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+		return fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	root, _ := schema.(map[string]any)
+	return validateSchema(root, root, value, "$")
+}
+
+// stripCodeFence removes a Markdown code fence some models wrap JSON in
+func stripCodeFence(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+	content = strings.TrimPrefix(content, "```")
+	if i := strings.IndexByte(content, '\n'); i >= 0 {
+		content = content[i+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+}
+
+// validateSchema validates value against the subset of JSON Schema used for
+// structured outputs: types, properties, required, additionalProperties,
+// items, enum, const, numeric and length bounds, pattern, the anyOf/oneOf/allOf
+// combinators and local $refs.
+func validateSchema(root, schema map[string]any, value any, path string) error {
+	if schema == nil {
+		return nil
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := resolveRef(root, ref)
+		if err != nil {
+			return err
+		}
+		return validateSchema(root, target, value, path)
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		return fmt.Errorf("%s: expected type %v", path, t)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	for _, sub := range schemaList(schema["allOf"]) {
+		if err := validateSchema(root, sub, value, path); err != nil {
+			return err
+		}
+	}
+	if anyOf := schemaList(schema["anyOf"]); len(anyOf) > 0 {
+		matched := false
+		for _, sub := range anyOf {
+			if validateSchema(root, sub, value, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value matches none of anyOf", path)
+		}
+	}
+	if oneOf := schemaList(schema["oneOf"]); len(oneOf) > 0 {
+		matches := 0
+		for _, sub := range oneOf {
+			if validateSchema(root, sub, value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: value matches %d of oneOf", path, matches)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		return validateObject(root, schema, v, path)
+	case []any:
+		if err := checkBound(schema, "minItems", "maxItems", float64(len(v)), path, "items"); err != nil {
+			return err
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateSchema(root, items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if err := checkBound(schema, "minLength", "maxLength", float64(utf8.RuneCountInString(v)), path, "characters"); err != nil {
+			return err
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern: %w", path, err)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%s: does not match pattern %q", path, pattern)
+			}
+		}
+	case float64:
+		if err := checkBound(schema, "minimum", "maximum", v, path, ""); err != nil {
+			return err
+		}
+		if limit, ok := schema["exclusiveMinimum"].(float64); ok && v <= limit {
+			return fmt.Errorf("%s: must be greater than %v", path, limit)
+		}
+		if limit, ok := schema["exclusiveMaximum"].(float64); ok && v >= limit {
+			return fmt.Errorf("%s: must be less than %v", path, limit)
+		}
+	}
+	return nil
+}
+
+func validateObject(root, schema map[string]any, obj map[string]any, path string) error {
+	properties, _ := schema["properties"].(map[string]any)
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; !present {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+	for name, propValue := range obj {
+		propPath := path + "." + name
+		if propSchema, ok := properties[name].(map[string]any); ok {
+			if err := validateSchema(root, propSchema, propValue, propPath); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unexpected property", propPath)
+			}
+		case map[string]any:
+			if err := validateSchema(root, additional, propValue, propPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func matchesType(t any, value any) bool {
+	switch t := t.(type) {
+	case string:
+		return matchesTypeName(t, value)
+	case []any:
+		for _, name := range t {
+			if s, ok := name.(string); ok && matchesTypeName(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, value any) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func checkBound(schema map[string]any, minKey, maxKey string, n float64, path, unit string) error {
+	if limit, ok := schema[minKey].(float64); ok && n < limit {
+		return fmt.Errorf("%s: fewer than %v %s", path, limit, unit)
+	}
+	if limit, ok := schema[maxKey].(float64); ok && n > limit {
+		return fmt.Errorf("%s: more than %v %s", path, limit, unit)
+	}
+	return nil
+}
+
+func schemaList(v any) []map[string]any {
+	list, _ := v.([]any)
+	var out []map[string]any
+	for _, item := range list {
+		if m, ok := item.(map[string]any); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// resolveRef resolves a local JSON pointer such as "#/$defs/Address"
+func resolveRef(root map[string]any, ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node any = root
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = m[part]
+	}
+	target, ok := node.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return target, nil
+}
+
+func jsonEqual(a, b any) bool {
+	aj, err1 := json.Marshal(a)
+	bj, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(aj, bj)
+}
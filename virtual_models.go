@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// virtualModel is a model name offered in free mode that stands for a
+// routing strategy rather than one model. Each request resolves it against
+// the live catalog and health stats: the free models it allows are tried in
+// its order, with the usual fallback between them.
+type virtualModel struct {
+	ID          string
+	Name        string
+	Description string
+	// allows reports whether a free model may serve the virtual model; nil
+	// allows every free model
+	allows func(m catalogModel) bool
+	// less orders the allowed models; nil keeps the health ranking
+	less func(a, b catalogModel, sa, sb ModelStats) bool
+}
+
+var virtualModels = []*virtualModel{
+	{
+		ID:          "free/auto",
+		Name:        "Auto (best-ranked free model)",
+		Description: "The free model ranked best by recent success rate, latency, throughput and context length.",
+	},
+	{
+		ID:          "free/fastest",
+		Name:        "Fastest free model",
+		Description: "The free model with the lowest median latency over the last six hours; unmeasured models come last.",
+		less: func(_, _ catalogModel, sa, sb ModelStats) bool {
+			if (sa.Successes > 0) != (sb.Successes > 0) {
+				return sa.Successes > 0
+			}
+			return sa.LatencyP50Ms < sb.LatencyP50Ms
+		},
+	},
+	{
+		ID:          "free/longest-context",
+		Name:        "Longest-context free model",
+		Description: "The free model with the largest context window.",
+		less: func(a, b catalogModel, _, _ ModelStats) bool {
+			return a.EffectiveContextLength() > b.EffectiveContextLength()
+		},
+	},
+	{
+		ID:          "free/tools",
+		Name:        "Tool-capable free model",
+		Description: "The best-ranked free model that supports tool calling.",
+		allows:      func(m catalogModel) bool { return supportsToolUse(m.SupportedParameters) },
+	},
+	{
+		ID:          "free/vision",
+		Name:        "Vision free model",
+		Description: "The best-ranked free model that accepts image input.",
+		allows:      func(m catalogModel) bool { return supportsImages(m.Architecture.InputModalities) },
+	},
+	{
+		ID:          "free/reasoning",
+		Name:        "Reasoning free model",
+		Description: "The best-ranked free model that supports reasoning.",
+		allows:      func(m catalogModel) bool { return supportsReasoning(m.SupportedParameters) },
+	},
+}
+
+// lookupVirtualModel returns the virtual model called name, or nil. Ollama
+// clients may append the default ":latest" tag.
+func lookupVirtualModel(name string) *virtualModel {
+	name = strings.TrimSuffix(name, ":latest")
+	for _, v := range virtualModels {
+		if v.ID == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// Allows reports whether m may serve the virtual model; a nil virtual model
+// allows every model
+func (v *virtualModel) Allows(m catalogModel) bool {
+	return v == nil || v.allows == nil || v.allows(m)
+}
+
+// info describes the virtual model as a catalog record for the listings and
+// /api/show: it is free, has the largest context of its candidates and
+// advertises the capabilities all of them share
+func (v *virtualModel) info(candidates []catalogModel) catalogModel {
+	m := catalogModel{ID: v.ID, Name: v.Name, Description: v.Description}
+	m.Pricing.Prompt, m.Pricing.Completion = "0", "0"
+	for i, c := range candidates {
+		m.ContextLength = max(m.ContextLength, c.EffectiveContextLength())
+		if i == 0 {
+			m.Architecture.InputModalities = c.Architecture.InputModalities
+			m.SupportedParameters = c.SupportedParameters
+			continue
+		}
+		m.Architecture.InputModalities = intersect(m.Architecture.InputModalities, c.Architecture.InputModalities)
+		m.SupportedParameters = intersect(m.SupportedParameters, c.SupportedParameters)
+	}
+	return m
+}
+
+// VirtualCandidates returns the free models admitted by the filter that may
+// serve v, in catalog order
+func (s *catalogService) VirtualCandidates(v *virtualModel) []catalogModel {
+	snap := s.snapshot()
+	var models []catalogModel
+	for _, id := range snap.free.IDs {
+		m := snap.catalog.Model(id)
+		if s.Allowed(id) && v.Allows(m) {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+// listVirtual returns the virtual models that have at least one candidate
+func (s *catalogService) listVirtual() []listedModel {
+	var models []listedModel
+	for _, v := range virtualModels {
+		if candidates := s.VirtualCandidates(v); len(candidates) > 0 {
+			models = append(models, listedModel{ID: v.ID, Name: v.ID, Info: v.info(candidates)})
+		}
+	}
+	return models
+}
+
+// virtualModel returns the virtual model a client asked for, or nil when the
+// name is not one or the proxy is not in free mode
+func (s *server) virtualModel(name string) *virtualModel {
+	if !s.freeMode {
+		return nil
+	}
+	return lookupVirtualModel(name)
+}
+
+// freeCandidates returns the free models to try for a request, best first:
+// the health ranking, narrowed and reordered by v when it is set
+func (s *server) freeCandidates(v *virtualModel) []string {
+	ranked, stats := s.rankedFreeModels()
+	if v == nil {
+		return ranked
+	}
+	catalog := s.models.Catalog()
+	var models []string
+	for _, m := range ranked {
+		if v.Allows(catalog.Model(m)) {
+			models = append(models, m)
+		}
+	}
+	if v.less == nil {
+		return models
+	}
+	sort.SliceStable(models, func(i, j int) bool {
+		a, b := models[i], models[j]
+		return v.less(catalog.Model(a), catalog.Model(b), stats[a], stats[b])
+	})
+	return models
+}
+
+// intersect returns the elements of a that are also in b
+func intersect(a, b []string) []string {
+	var out []string
+	for _, s := range a {
+		if contains(b, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}